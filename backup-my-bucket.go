@@ -23,14 +23,22 @@ import (
 	"flag"
 	"fmt"
 	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/diff"
+	"github.com/SegundamanoMX/backup-my-bucket/find"
 	"github.com/SegundamanoMX/backup-my-bucket/gc"
 	"github.com/SegundamanoMX/backup-my-bucket/ls"
 	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"github.com/SegundamanoMX/backup-my-bucket/recompress"
+	"github.com/SegundamanoMX/backup-my-bucket/rekey"
 	"github.com/SegundamanoMX/backup-my-bucket/restore"
 	"github.com/SegundamanoMX/backup-my-bucket/snapshot"
+	"github.com/SegundamanoMX/backup-my-bucket/tag"
+	"github.com/SegundamanoMX/backup-my-bucket/verify"
 	"io/ioutil"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 )
 
 var (
@@ -42,25 +50,182 @@ func main() {
 	parseParams()
 	loadConfig()
 	log.Init(common.Cfg.Syslog, common.Cfg.LogLevel)
+	common.CheckEncryptionConfig()
+	common.CheckCompressionConfig()
+	common.CheckSnapshotEncryptionConfig()
 	for i, param := range flag.Args() {
 		switch param {
 		case "snapshot":
-			snapshot.Snapshot()
+			flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+			changes := flags.String("changes", "", "Take incremental snapshot from file of S3 event notifications")
+			parent := flags.String("parent", "latest", "Snapshot that incremental snapshot is a delta of")
+			inventory := flags.String("from-inventory", "", "Take snapshot from S3 Inventory manifest, local or s3://BUCKET/KEY")
+			label := flags.String("label", "", "Comma separated labels of snapshot, e.g. pre-migration")
+			note := flags.String("note", "", "Description of snapshot")
+			flags.Parse(flag.Args()[i+1:])
+			if flags.NArg() != 0 {
+				log.Fatal("Too many parameters for command snapshot: %s", flags.Args())
+			}
+			if *changes != "" && *inventory != "" {
+				log.Fatal("Command snapshot takes either -changes or -from-inventory, not both.")
+			}
+			snapshot.Label(splitLabels(*label), *note)
+			if *inventory != "" {
+				snapshot.SnapshotFromInventory(*inventory)
+			} else if *changes != "" {
+				snapshot.SnapshotIncremental(*changes, *parent)
+			} else {
+				snapshot.Snapshot()
+			}
 			return
 		case "list-snapshots":
-			ls.ListSnapshots()
+			flags := flag.NewFlagSet("list-snapshots", flag.ExitOnError)
+			label := flags.String("label", "", "List only snapshots carrying label")
+			flags.Parse(flag.Args()[i+1:])
+			if flags.NArg() != 0 {
+				log.Fatal("Too many parameters for command list-snapshots: %s", flags.Args())
+			}
+			ls.ListSnapshots(*label)
+			return
+		case "tag":
+			flags := flag.NewFlagSet("tag", flag.ExitOnError)
+			note := flags.String("note", "", "Replace description of snapshot")
+			remove := flags.Bool("remove", false, "Remove labels from snapshot instead of adding them")
+			params := parseCommand(flags, flag.Args()[i+1:])
+			setNote := false
+			flags.Visit(func(f *flag.Flag) { setNote = setNote || f.Name == "note" })
+			if len(params) == 0 || len(params) == 1 && !setNote {
+				log.Fatal("Command tag takes a snapshot and labels to add or remove, or option -note: %s", params)
+			}
+			tag.Tag(params[0], params[1:], *remove, *note, setNote)
 			return
 		case "restore":
-			snapshotName := flag.Args()[i+1:]
-			if len(snapshotName) == 1 {
-				restore.Restore(snapshotName[0])
+			flags := flag.NewFlagSet("restore", flag.ExitOnError)
+			force := flags.Bool("force", false, "Restore snapshot even when taken of a bucket other than the slave bucket")
+			at := flags.String("at", "", "Restore to point in time instead of snapshot, e.g. 2015-06-05T15:21:58-05:00")
+			verifyAfter := flags.Bool("verify", false, "Verify master bucket against snapshot after restore")
+			flags.Parse(flag.Args()[i+1:])
+			snapshotName := flags.Args()
+			if *at != "" && len(snapshotName) == 0 {
+				restore.RestoreAt(parseTimestamp(*at), *verifyAfter)
+				return
+			} else if *at == "" && len(snapshotName) == 1 {
+				restore.Restore(snapshotName[0], *force, *verifyAfter)
 				return
 			} else {
 				log.Fatal("Too many or too few parameters for command restore: %s", snapshotName)
 			}
+		case "restore-key", "get":
+			flags := flag.NewFlagSet(param, flag.ExitOnError)
+			force := flags.Bool("force", false, "Use snapshot even when taken of a bucket other than the slave bucket")
+			versionId := flags.String("version-id", "", "Version of key in slave to use instead of the one in a snapshot")
+			output := flags.String("o", "", "File where command get writes the version")
+			params := parseCommand(flags, flag.Args()[i+1:])
+			snapshotName := ""
+			if *versionId == "" && len(params) == 2 {
+				snapshotName = params[0]
+			} else if *versionId == "" || len(params) != 1 {
+				log.Fatal("Command %s takes either a snapshot and a key, or option -version-id and a key: %s", param, params)
+			}
+			key := params[len(params) - 1]
+			if param == "get" {
+				if *output == "" {
+					log.Fatal("Command get takes option -o FILE.")
+				}
+				restore.Get(snapshotName, key, *versionId, *output, *force)
+			} else {
+				restore.RestoreKey(snapshotName, key, *versionId, *force)
+			}
+			return
 		case "gc":
 			gc.GarbageCollect()
 			return
+		case "import-index":
+			common.ImportIndex()
+			return
+		case "reconstruct-snapshot":
+			flags := flag.NewFlagSet("reconstruct-snapshot", flag.ExitOnError)
+			at := flags.String("at", "", "Point in time of snapshot, e.g. 2015-06-05T15:21:58-05:00")
+			flags.Parse(flag.Args()[i+1:])
+			if *at == "" || flags.NArg() != 0 {
+				log.Fatal("Command reconstruct-snapshot takes exactly option -at TIMESTAMP.")
+			}
+			snapshot.Reconstruct(parseTimestamp(*at))
+			return
+		case "verify-snapshot":
+			snapshotNames := flag.Args()[i+1:]
+			if len(snapshotNames) == 0 {
+				log.Fatal("Too few parameters for command verify-snapshot: %s", snapshotNames)
+			}
+			verify.VerifySnapshots(snapshotNames)
+			return
+		case "recompress":
+			flags := flag.NewFlagSet("recompress", flag.ExitOnError)
+			codec := flags.String("codec", "", "Codec of snapshot files: none, gzip or zstd, as configured by default")
+			level := flags.Int("level", 0, "Level of codec, 0 for its default level")
+			force := flags.Bool("force", false, "Recompress snapshot files compressed by codec already")
+			params := parseCommand(flags, flag.Args()[i+1:])
+			if len(params) == 0 {
+				log.Fatal("Too few parameters for command recompress: %s", params)
+			}
+			if *codec == "" {
+				*codec, *level = common.ConfiguredCompression()
+			}
+			recompress.Recompress(params, *codec, *level, *force)
+			return
+		case "rekey":
+			flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+			oldIdentity := flags.String("old-identity", "", "File of age identities that snapshot files were encrypted to")
+			oldPassphrase := flags.String("old-passphrase-file", "", "File holding passphrase that snapshot files were encrypted under")
+			params := parseCommand(flags, flag.Args()[i+1:])
+			if len(params) == 0 {
+				log.Fatal("Too few parameters for command rekey: %s", params)
+			}
+			rekey.Rekey(params, *oldIdentity, *oldPassphrase)
+			return
+		case "check-snapshot":
+			flags := flag.NewFlagSet("check-snapshot", flag.ExitOnError)
+			rate := flags.Int("rate", common.Cfg.BackupSet.CheckRequestRate, "Maximum requests per second, 0 for no limit")
+			params := parseCommand(flags, flag.Args()[i+1:])
+			if len(params) == 0 {
+				log.Fatal("Too few parameters for command check-snapshot: %s", params)
+			}
+			if *rate < 0 || *rate > verify.MaxRequestRate {
+				log.Fatal("Option -rate takes 0 to %d requests per second, got %d.", verify.MaxRequestRate, *rate)
+			}
+			verify.CheckSnapshots(params, *rate)
+			return
+		case "verify":
+			flags := flag.NewFlagSet("verify", flag.ExitOnError)
+			target := flags.String("target", verify.Master, "Bucket to verify, master or slave")
+			deep := flags.Bool("deep", false, "Download objects and compare content hashes")
+			params := parseCommand(flags, flag.Args()[i+1:])
+			if len(params) != 1 {
+				log.Fatal("Command verify takes exactly one snapshot: %s", params)
+			}
+			if !verify.VerifyBucket(common.FetchSnapshot(params[0]), *target, *deep) {
+				os.Exit(1)
+			}
+			return
+		case "diff":
+			flags := flag.NewFlagSet("diff", flag.ExitOnError)
+			format := flags.String("format", "text", "Output format, one of text, json and csv")
+			summary := flags.Bool("summary", false, "Print only counts and size deltas of changes")
+			flags.Parse(flag.Args()[i+1:])
+			if flags.NArg() != 2 {
+				log.Fatal("Command diff takes exactly two snapshots: %s", flags.Args())
+			}
+			diff.Diff(flags.Arg(0), flags.Arg(1), *format, *summary)
+			return
+		case "find-key":
+			flags := flag.NewFlagSet("find-key", flag.ExitOnError)
+			prefix := flags.Bool("prefix", false, "Find every key starting with given prefix")
+			flags.Parse(flag.Args()[i+1:])
+			if flags.NArg() != 1 {
+				log.Fatal("Command find-key takes exactly one key: %s", flags.Args())
+			}
+			find.FindKey(flags.Arg(0), *prefix)
+			return
 		default:
 			log.Fatal("Found unhandled command '%s'.", param)
 		}
@@ -70,12 +235,41 @@ func main() {
 
 func parseParams() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: backup-my-bucket [-help] [-config] {snapshot,list-snapshots,restore,gc}:\n")
+		fmt.Fprintf(os.Stderr, "usage: backup-my-bucket [-help] [-config] {snapshot,list-snapshots,restore,gc,verify-snapshot,reconstruct-snapshot,check-snapshot,verify,diff,find-key,restore-key,get,import-index,recompress,rekey,tag}:\n")
 		fmt.Fprintf(os.Stderr, "commands:\n")
 		fmt.Fprintf(os.Stderr, "  snapshot:                          Create a restoration point\n")
-		fmt.Fprintf(os.Stderr, "  list-snapshots:                    List available restoration points\n")
-		fmt.Fprintf(os.Stderr, "  restore:                           Restore master bucket at given restoration point\n")
+		fmt.Fprintf(os.Stderr, "  snapshot -changes FILE [-parent SNAPSHOT]:\n")
+		fmt.Fprintf(os.Stderr, "                                     Create a restoration point from changes since given one\n")
+		fmt.Fprintf(os.Stderr, "  snapshot -from-inventory MANIFEST: Create a restoration point from an S3 Inventory report\n")
+		fmt.Fprintf(os.Stderr, "  snapshot ... [-label L,...] [-note TEXT]:\n")
+		fmt.Fprintf(os.Stderr, "                                     Create a restoration point with given labels and description\n")
+		fmt.Fprintf(os.Stderr, "  list-snapshots [-label L]:         List available restoration points, or those carrying label\n")
+		fmt.Fprintf(os.Stderr, "  tag [-remove] [-note TEXT] <SNAPSHOT> [LABEL...]:\n")
+		fmt.Fprintf(os.Stderr, "                                     Add or remove labels of restoration point, or set its description\n")
+		fmt.Fprintf(os.Stderr, "  restore [-force] [-verify] <SNAPSHOT>:\n")
+		fmt.Fprintf(os.Stderr, "                                     Restore master bucket at given restoration point\n")
+		fmt.Fprintf(os.Stderr, "  restore [-verify] -at TIME:        Restore master bucket at given point in time\n")
+		fmt.Fprintf(os.Stderr, "  restore-key [-force] <SNAPSHOT> <KEY>:\n")
+		fmt.Fprintf(os.Stderr, "                                     Restore single key of master bucket at given restoration point\n")
+		fmt.Fprintf(os.Stderr, "  restore-key -version-id ID <KEY>:  Restore single key of master bucket to given version in slave\n")
+		fmt.Fprintf(os.Stderr, "  get [-force] <SNAPSHOT> <KEY> -o FILE:\n")
+		fmt.Fprintf(os.Stderr, "                                     Download version of key at given restoration point\n")
+		fmt.Fprintf(os.Stderr, "  get -version-id ID <KEY> -o FILE:  Download given version of key in slave\n")
 		fmt.Fprintf(os.Stderr, "  gc:                                Garbage collect obsolete restoration points\n")
+		fmt.Fprintf(os.Stderr, "  recompress [-codec C] [-level N] [-force] <SNAPSHOT...>|all:\n")
+		fmt.Fprintf(os.Stderr, "                                     Rewrite snapshot files compressed by given codec\n")
+		fmt.Fprintf(os.Stderr, "  rekey [-old-identity FILE] [-old-passphrase-file FILE] <SNAPSHOT...>|all:\n")
+		fmt.Fprintf(os.Stderr, "                                     Rewrite snapshot files encrypted under configured keys\n")
+		fmt.Fprintf(os.Stderr, "  import-index:                      Index restoration points missing from index\n")
+		fmt.Fprintf(os.Stderr, "  verify-snapshot <SNAPSHOT...>|all: Verify integrity of snapshot files\n")
+		fmt.Fprintf(os.Stderr, "  reconstruct-snapshot -at TIME:     Reconstruct restoration point at given time from slave history\n")
+		fmt.Fprintf(os.Stderr, "  check-snapshot [-rate N] <SNAPSHOT...>|all:\n")
+		fmt.Fprintf(os.Stderr, "                                     Check that slave bucket holds every version of restoration points\n")
+		fmt.Fprintf(os.Stderr, "  verify [-target master|slave] [-deep] <SNAPSHOT>:\n")
+		fmt.Fprintf(os.Stderr, "                                     Verify bucket against restoration point\n")
+		fmt.Fprintf(os.Stderr, "  diff [-format text|json|csv] [-summary] <SNAPSHOT_A> <SNAPSHOT_B>:\n")
+		fmt.Fprintf(os.Stderr, "                                     List keys added, removed and modified between restoration points\n")
+		fmt.Fprintf(os.Stderr, "  find-key [-prefix] <KEY>:          Print version of key in every restoration point\n")
 		fmt.Fprintf(os.Stderr, "optional arguments:\n")
 		flag.PrintDefaults()
 	}
@@ -104,3 +298,36 @@ func loadConfig()  {
 		os.Exit(1)
 	}
 }
+
+// Parse flags of command, which may come before, between or after its
+// parameters. Return the parameters.
+func parseCommand(flags *flag.FlagSet, args []string) (params []string) {
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return
+		}
+		params = append(params, args[0])
+		args = args[1:]
+	}
+}
+
+// Split comma separated list of labels, dropping blanks, so an empty list
+// holds no label.
+func splitLabels(list string) (labels []string) {
+	for _, label := range strings.Split(list, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return
+}
+
+func parseTimestamp(value string) time.Time {
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatal("Could not parse timestamp '%s', expected format is 2006-01-02T15:04:05-07:00: %s", value, err)
+	}
+	return timestamp
+}
@@ -24,7 +24,8 @@ License:        Copyright 2015 ASM Clasificados de Mexico, SA de CV
 URL:            https://github.com/SegundamanoMX/backup-my-bucket
 Source:         https://github.com/SegundamanoMX/backup-my-bucket
 
-BuildRequires:  golang >= 1.3.3
+BuildRequires:  golang >= 1.22
+BuildRequires:  git
 
 %define _topdir %(pwd)/build
 %define _src %(pwd)
@@ -37,12 +38,22 @@ AWS.  backup-my-bucket is written in Golang.
 
 %prep
 export GOPATH=%{_builddir}
-go get -d github.com/vaughan0/go-ini github.com/aws/aws-sdk-go
+# Dependencies at the versions listed in README.md, in GOPATH.
+fetch() { rm -rf $GOPATH/src/$1 && git clone -q --depth 1 --branch $3 $2 $GOPATH/src/$1; }
+fetch github.com/vaughan0/go-ini https://github.com/vaughan0/go-ini master
+fetch github.com/aws/aws-sdk-go https://github.com/aws/aws-sdk-go v0.9.17
+fetch github.com/boltdb/bolt https://github.com/boltdb/bolt v1.3.1
+fetch github.com/klauspost/compress https://github.com/klauspost/compress v1.18.0
+fetch github.com/klauspost/pgzip https://github.com/klauspost/pgzip v1.2.6
+fetch filippo.io/age https://github.com/FiloSottile/age v1.2.1
+fetch golang.org/x/crypto https://go.googlesource.com/crypto v0.24.0
+fetch golang.org/x/sys https://go.googlesource.com/sys v0.21.0
 mkdir -p %{_pkg}
-cd %{_src} && cp -r *.go *.conf common gc log ls restore snapshot  %{_builddir}/%{_pkg}
+cd %{_src} && cp -r *.go *.conf common diff find gc log ls recompress rekey restore snapshot tag verify  %{_builddir}/%{_pkg}
 
 %build
 export GOPATH=%{_builddir}
+export GO111MODULE=off
 cd %{_pkg} && go build
 
 %pre
@@ -0,0 +1,434 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A catalog stores the snapshot files of the backup set. The local catalog
+// keeps them in SnapshotsDir. The S3 catalog keeps them in a bucket and
+// caches them in SnapshotsDir, so that they survive the loss of the backup
+// host.
+type SnapshotCatalog interface {
+	// Names of snapshot files in catalog.
+	List() []string
+	// Path to local copy of snapshot file, fetched from catalog if need be.
+	Fetch(name string) string
+	// Store local snapshot file in catalog.
+	Store(file string)
+	// Remove snapshot file from catalog and from local cache.
+	Remove(name string)
+	// Names of chunks in pack store of catalog, with their modification time.
+	ListChunks() map[string]time.Time
+	// Path to local copy of chunk, fetched from catalog if need be.
+	FetchChunk(id string) string
+	// Store local chunk file in pack store of catalog, unless it is there, in
+	// which case its modification time is refreshed.
+	StoreChunk(file string)
+	// Store local chunk file in pack store of catalog over the one there.
+	ReplaceChunk(file string)
+	// Remove chunk from catalog and from local cache.
+	RemoveChunk(id string)
+}
+
+type localCatalog struct {
+	dir                  string
+}
+
+type s3Catalog struct {
+	localCatalog
+	bucket               string
+	prefix               string
+	client               *s3.S3
+	remote               map[string]*s3.Object
+	chunks               map[string]time.Time
+}
+
+var (
+	catalog              SnapshotCatalog
+)
+
+// Catalog of backup set as configured.
+func Catalog() SnapshotCatalog {
+	if catalog != nil {
+		return catalog
+	}
+	local := localCatalog{dir: Cfg.BackupSet.SnapshotsDir}
+	cfg := Cfg.BackupSet.Catalog
+	if cfg.Bucket == "" {
+		catalog = &local
+		return catalog
+	}
+
+	if cfg.Bucket == Cfg.BackupSet.SlaveBucket && cfg.Prefix == "" {
+		log.Fatal("Catalog in slave bucket %s needs a prefix, so snapshot files are not taken for contents of the bucket.", cfg.Bucket)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = Cfg.BackupSet.SlaveRegion
+	}
+	log.Info("Using catalog in bucket %s, region %s, prefix '%s'.", cfg.Bucket, region, cfg.Prefix)
+	catalog = &s3Catalog{
+		localCatalog: local,
+		bucket: cfg.Bucket,
+		prefix: cfg.Prefix,
+		client: s3.New(&aws.Config{
+			Credentials: credentials.NewStaticCredentials(Cfg.BackupSet.AccessKey, Cfg.BackupSet.SecretKey, ""),
+			Region: aws.String(region),
+		}),
+	}
+	return catalog
+}
+
+// Tell whether key of slave bucket belongs to the catalog rather than to the
+// contents of the bucket.
+func IsCatalogKey(key string) bool {
+	cfg := Cfg.BackupSet.Catalog
+	return cfg.Bucket == Cfg.BackupSet.SlaveBucket && cfg.Prefix != "" && strings.HasPrefix(key, cfg.Prefix)
+}
+
+func (c *localCatalog) List() (names []string) {
+	matches, _ := filepath.Glob(c.dir + "/*")
+	for _, file := range matches {
+		name := filepath.Base(file)
+		if strings.HasPrefix(name, ".") {
+			log.Debug("Skip hidden file '%s'.", file)
+			continue
+		}
+		if name == PackDir {
+			continue
+		}
+		names = append(names, name)
+	}
+	return
+}
+
+func (c *localCatalog) Fetch(name string) string {
+	return filepath.Join(c.dir, name)
+}
+
+func (c *localCatalog) Store(file string) {
+}
+
+func (c *localCatalog) Remove(name string) {
+	if err := os.Remove(c.Fetch(name)); err != nil && !os.IsNotExist(err) {
+		log.Error("Error removing snapshot '%s': %s", name, err)
+	}
+}
+
+func (c *localCatalog) ListChunks() map[string]time.Time {
+	chunks := make(map[string]time.Time)
+	matches, _ := filepath.Glob(filepath.Join(c.dir, PackDir, "*"))
+	for _, file := range matches {
+		id := filepath.Base(file)
+		if strings.HasPrefix(id, ".") {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			chunks[id] = info.ModTime()
+		}
+	}
+	return chunks
+}
+
+func (c *localCatalog) FetchChunk(id string) string {
+	return filepath.Join(c.dir, PackDir, id)
+}
+
+func (c *localCatalog) StoreChunk(file string) {
+}
+
+func (c *localCatalog) ReplaceChunk(file string) {
+}
+
+func (c *localCatalog) RemoveChunk(id string) {
+	if err := os.Remove(c.FetchChunk(id)); err != nil && !os.IsNotExist(err) {
+		log.Error("Error removing chunk %s: %s", id, err)
+	}
+}
+
+func (c *s3Catalog) List() (names []string) {
+	c.remote = make(map[string]*s3.Object)
+	params := &s3.ListObjectsInput{
+		Bucket:          aws.String(c.bucket),
+		Prefix:          aws.String(c.prefix),
+	}
+	for {
+		resp, err := c.client.ListObjects(params)
+		if err != nil {
+			log.Fatal("Could not list catalog in bucket %s: %s", c.bucket, err)
+		}
+		for _, object := range resp.Contents {
+			name := strings.TrimPrefix(*object.Key, c.prefix)
+			if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+				continue
+			}
+			c.remote[name] = object
+			names = append(names, name)
+		}
+		if !aws.BoolValue(resp.IsTruncated) || len(resp.Contents) == 0 { break }
+		params.Marker = resp.Contents[len(resp.Contents) - 1].Key
+	}
+
+	for _, name := range c.localCatalog.List() {
+		if _, ok := c.remote[name]; !ok {
+			log.Error("Snapshot file '%s' is cached locally but missing from catalog, ignoring it.", name)
+		}
+	}
+	return
+}
+
+// Fetch snapshot file unless the cached copy has the size and modification
+// time of the catalog copy.
+func (c *s3Catalog) Fetch(name string) string {
+	file := c.localCatalog.Fetch(name)
+	if c.remote == nil {
+		c.List()
+	}
+	object, ok := c.remote[name]
+	if !ok {
+		log.Fatal("Snapshot '%s' is not in catalog.", name)
+	}
+	if info, err := os.Stat(file); err == nil && info.Size() == *object.Size && info.ModTime().Equal(*object.LastModified) {
+		log.Debug("Using cached copy of snapshot '%s'.", name)
+		return file
+	}
+
+	log.Info("Fetching snapshot '%s' from catalog.", name)
+	resp, err := c.client.GetObject(&s3.GetObjectInput{
+		Bucket:          aws.String(c.bucket),
+		Key:             aws.String(c.prefix + name),
+	})
+	if err != nil {
+		log.Fatal("Could not fetch snapshot '%s' from catalog: %s", name, err)
+	}
+	defer resp.Body.Close()
+	err = WriteFileAtomically(file, func(f io.Writer) error {
+		_, err := io.Copy(f, resp.Body)
+		return err
+	})
+	if err != nil {
+		log.Fatal("Could not fetch snapshot '%s' from catalog: %s", name, err)
+	}
+	if err := os.Chtimes(file, time.Now(), *object.LastModified); err != nil {
+		log.Error("Could not set modification time of '%s': %s", file, err)
+	}
+	return file
+}
+
+func (c *s3Catalog) Store(file string) {
+	name := filepath.Base(file)
+	log.Info("Storing snapshot '%s' in catalog.", name)
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal("Could not open file %s: %s", file, err)
+	}
+	defer f.Close()
+	_, err = c.client.PutObject(&s3.PutObjectInput{
+		Bucket:          aws.String(c.bucket),
+		Key:             aws.String(c.prefix + name),
+		Body:            f,
+	})
+	if err != nil {
+		log.Fatal("Could not store snapshot '%s' in catalog: %s", name, err)
+	}
+	c.remote = nil
+
+	// The cached copy takes the modification time of the catalog copy, so
+	// that Fetch does not take it for out of date.
+	head, err := c.client.HeadObject(&s3.HeadObjectInput{
+		Bucket:          aws.String(c.bucket),
+		Key:             aws.String(c.prefix + name),
+	})
+	if err != nil {
+		log.Error("Could not query snapshot '%s' in catalog, it will be fetched again: %s", name, err)
+		return
+	}
+	if err := os.Chtimes(file, time.Now(), aws.TimeValue(head.LastModified)); err != nil {
+		log.Error("Could not set modification time of '%s': %s", file, err)
+	}
+}
+
+// Remove every version of snapshot file from catalog, so removed snapshots
+// do not linger in a versioned bucket such as the slave.
+func (c *s3Catalog) Remove(name string) {
+	if !c.removeKey(c.prefix + name) {
+		return
+	}
+	delete(c.remote, name)
+	c.localCatalog.Remove(name)
+}
+
+func (c *s3Catalog) ListChunks() map[string]time.Time {
+	c.chunks = make(map[string]time.Time)
+	params := &s3.ListObjectsInput{
+		Bucket:          aws.String(c.bucket),
+		Prefix:          aws.String(c.prefix + PackDir + "/"),
+	}
+	for {
+		resp, err := c.client.ListObjects(params)
+		if err != nil {
+			log.Fatal("Could not list pack store of catalog in bucket %s: %s", c.bucket, err)
+		}
+		for _, object := range resp.Contents {
+			c.chunks[path.Base(*object.Key)] = *object.LastModified
+		}
+		if !aws.BoolValue(resp.IsTruncated) || len(resp.Contents) == 0 { break }
+		params.Marker = resp.Contents[len(resp.Contents) - 1].Key
+	}
+	chunks := make(map[string]time.Time)
+	for id, modified := range c.chunks {
+		chunks[id] = modified
+	}
+	return chunks
+}
+
+// Fetch chunk unless it is cached. Chunks never change, and readers check
+// them against their names.
+func (c *s3Catalog) FetchChunk(id string) string {
+	file := c.localCatalog.FetchChunk(id)
+	if _, err := os.Stat(file); err == nil {
+		return file
+	}
+
+	log.Debug("Fetching chunk %s from catalog.", id)
+	resp, err := c.client.GetObject(&s3.GetObjectInput{
+		Bucket:          aws.String(c.bucket),
+		Key:             aws.String(c.prefix + PackDir + "/" + id),
+	})
+	if err != nil {
+		log.Fatal("Could not fetch chunk %s from catalog: %s", id, err)
+	}
+	defer resp.Body.Close()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		log.Fatal("Could not create pack store %s: %s", filepath.Dir(file), err)
+	}
+	err = WriteFileAtomically(file, func(f io.Writer) error {
+		_, err := io.Copy(f, resp.Body)
+		return err
+	})
+	if err != nil {
+		log.Fatal("Could not fetch chunk %s from catalog: %s", id, err)
+	}
+	return file
+}
+
+func (c *s3Catalog) StoreChunk(file string) {
+	id := filepath.Base(file)
+	if c.chunks == nil {
+		c.ListChunks()
+	}
+	if modified, ok := c.chunks[id]; ok {
+		if time.Since(modified) > time.Hour {
+			c.touchChunk(id)
+		}
+		return
+	}
+	c.ReplaceChunk(file)
+}
+
+// Copy chunk onto itself, so that its modification time is now and gc does
+// not take a chunk reused by a snapshot in progress for unreferenced.
+func (c *s3Catalog) touchChunk(id string) {
+	key := c.prefix + PackDir + "/" + id
+	log.Debug("Touching chunk %s in catalog.", id)
+	_, err := c.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(c.bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String((&url.URL{Path: c.bucket + "/" + key}).EscapedPath()),
+		MetadataDirective: aws.String("REPLACE"),
+	})
+	if err != nil {
+		log.Fatal("Could not touch chunk %s in catalog: %s", id, err)
+	}
+	c.chunks[id] = time.Now()
+}
+
+func (c *s3Catalog) ReplaceChunk(file string) {
+	id := filepath.Base(file)
+	if c.chunks == nil {
+		c.ListChunks()
+	}
+	log.Debug("Storing chunk %s in catalog.", id)
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal("Could not open file %s: %s", file, err)
+	}
+	defer f.Close()
+	_, err = c.client.PutObject(&s3.PutObjectInput{
+		Bucket:          aws.String(c.bucket),
+		Key:             aws.String(c.prefix + PackDir + "/" + id),
+		Body:            f,
+	})
+	if err != nil {
+		log.Fatal("Could not store chunk %s in catalog: %s", id, err)
+	}
+	c.chunks[id] = time.Now()
+}
+
+func (c *s3Catalog) RemoveChunk(id string) {
+	if !c.removeKey(c.prefix + PackDir + "/" + id) {
+		return
+	}
+	delete(c.chunks, id)
+	c.localCatalog.RemoveChunk(id)
+}
+
+// Remove every version of key from catalog bucket. Return ok false on
+// error.
+func (c *s3Catalog) removeKey(key string) (ok bool) {
+	resp, err := c.client.ListObjectVersions(&s3.ListObjectVersionsInput{
+		Bucket:          aws.String(c.bucket),
+		Prefix:          aws.String(key),
+	})
+	if err != nil {
+		log.Error("Error listing versions of '%s' in catalog: %s", key, err)
+		return false
+	}
+	var versionIds []*string
+	for _, v := range resp.Versions {
+		if *v.Key == key { versionIds = append(versionIds, v.VersionId) }
+	}
+	for _, m := range resp.DeleteMarkers {
+		if *m.Key == key { versionIds = append(versionIds, m.VersionId) }
+	}
+	for _, versionId := range versionIds {
+		_, err := c.client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket:          aws.String(c.bucket),
+			Key:             aws.String(key),
+			VersionId:       versionId,
+		})
+		if err != nil {
+			log.Error("Error removing '%s' from catalog: %s", key, err)
+			return false
+		}
+	}
+	return true
+}
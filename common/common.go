@@ -19,21 +19,44 @@ along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
 package common
 
 import (
-	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/SegundamanoMX/backup-my-bucket/log"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"time"
 )
 
+type CatalogConfig struct {
+	Bucket               string
+	Region               string
+	Prefix               string
+}
+
+// Fields of restored objects that restore strips, or overrides with given
+// values, instead of copying them from slave.
+type RestoreConfig struct {
+	Override             map[string]string
+	Strip                []string
+	CopyAcl              bool
+}
+
 type BackupSet struct {
+	Name                 string
 	SnapshotsDir         string
+	Catalog              CatalogConfig
 	CompressSnapshots    bool
+	SnapshotCompression  string
+	SnapshotCompressionLevel int
+	DeduplicateSnapshots bool
+	IndexFile            string
+	SnapshotEncryption   SnapshotEncryptionConfig
+	SnapshotObjectMetadata bool
+	SnapshotObjectTags   bool
+	CheckRequestRate     int
 	MinimumRedundancy    int
 	RetentionPolicy      int
 	MasterBucket         string
@@ -42,81 +65,183 @@ type BackupSet struct {
 	SlaveRegion          string
 	AccessKey            string
 	SecretKey            string
+	Encryption           EncryptionConfig
+	Restore              RestoreConfig
 }
 
 type AppConfig struct {
 	LogLevel             int
 	AwsLogLevel          aws.LogLevelType
 	Syslog               bool
+	SkipSnapshotVerification bool
 	BackupSet            BackupSet
 }
 
+type Owner struct {
+	ID                   string
+	DisplayName          string `json:",omitempty"`
+}
+
+// A version of a key in slave bucket. A delete marker is recorded as a
+// version with DeleteMarker set. Fields after Owner are only recorded when
+// configured, since they take one more request per version. Removed is only
+// set in delta snapshots, for keys that have no versions left.
 type Version struct {
 	Key                  string
 	LastModified         time.Time
 	Size                 int64
 	VersionId            string
+	DeleteMarker         bool `json:",omitempty"`
+	ETag                 string `json:",omitempty"`
+	StorageClass         string `json:",omitempty"`
+	Owner                *Owner `json:",omitempty"`
+	ContentType          string `json:",omitempty"`
+	CacheControl         string `json:",omitempty"`
+	ContentDisposition   string `json:",omitempty"`
+	ContentEncoding      string `json:",omitempty"`
+	ContentLanguage      string `json:",omitempty"`
+	Metadata             map[string]string `json:",omitempty"`
+	Encryption           string `json:",omitempty"`
+	KMSKeyId             string `json:",omitempty"`
+	Tags                 map[string]string `json:",omitempty"`
+	Removed              bool `json:",omitempty"`
+}
+
+type SnapshotHeader struct {
+	Format               int
+	Timestamp            time.Time
+	BackupSet            string
+	Bucket               string
+	Region               string
+	ToolVersion          string
+	Hostname             string
+	Duration             time.Duration
+	KeyCount             int64
+	DeleteMarkerCount    int64 `json:",omitempty"`
+	TotalBytes           int64
+	Digest               string
+	Reconstructed        bool
+	Parent               string `json:",omitempty"`
+	Inventory            string `json:",omitempty"`
+	Labels               []string `json:",omitempty"`
+	Note                 string `json:",omitempty"`
 }
 
 type Snapshot struct {
 	File                 string
-	Timestamp            time.Time `json:"Timestamp"`
-	Contents             []Version `json:"Contents"`
+	SnapshotHeader
+	Corruption           error `json:"-"`
 }
 
 const (
+	AppVersion           = "0.1.0"
+	SnapshotNameLayout   = "20060102150405-0700MST"
 	SnapshotWorkerCount  = 128
 	SnapshotBatchSize    = 100000
 	RestoreWorkerCount   = 1024
+	VerifyWorkerCount    = 64
 	MaxRetries           = 10
 	GcBatchSize          = 1
+	GcQueueSize          = 100000
+	ChunkAverageRecords  = 1024
+	ChunkMaxRecords      = 8192
+	IndexBatchSize       = 10000
 )
 
 var (
 	Cfg                  AppConfig
+	SortRunSize          = 1000000
+	SortMergeWidth       = 64
 )
 
-func LoadSnapshots() (snapshots []Snapshot) {
-	log.Info("Loading snapshots")
-	files, _ := filepath.Glob(Cfg.BackupSet.SnapshotsDir + "/*")
-	for _, file := range files {
-		snapshots = append(snapshots, LoadSnapshot(file))
+// List local copies of the snapshot files in catalog, fetching them if need
+// be.
+func SnapshotFiles() (files []string) {
+	for _, name := range Catalog().List() {
+		files = append(files, Catalog().Fetch(name))
 	}
 	return
 }
 
-func LoadSnapshot(file string) (snapshot Snapshot) {
-	log.Info("Loading snapshot file '%s'.", file)
-	var bytes []byte
-	var readErr error
-	if filepath.Ext(file) == ".Z" {
-		f, openErr := os.OpenFile(file, os.O_RDONLY, 0000)
-		if openErr != nil {
-			log.Fatal("Could not open file %s: %s", file, openErr)
+// Remove temporary files left in the snapshots directory by snapshots that
+// crashed before completion. Only files older than a day are removed, so
+// snapshots in progress are left alone.
+func RemoveStaleTempFiles() {
+	matches, _ := filepath.Glob(Cfg.BackupSet.SnapshotsDir + "/" + TempFilePrefix + "*")
+	chunkMatches, _ := filepath.Glob(filepath.Join(Cfg.BackupSet.SnapshotsDir, PackDir, TempFilePrefix + "*"))
+	matches = append(matches, chunkMatches...)
+	for _, file := range matches {
+		info, err := os.Stat(file)
+		if err != nil || time.Since(info.ModTime()) < 24 * time.Hour {
+			continue
 		}
-		defer f.Close()
-
-		r, nrErr := gzip.NewReader(f)
-		if nrErr != nil {
-			log.Fatal("Could not initialize gzip decompressor: %s", nrErr)
+		log.Info("Removing stale temporary file '%s'.", file)
+		if err := os.Remove(file); err != nil {
+			log.Error("Error removing stale temporary file '%s': %s", file, err)
 		}
-		defer r.Close()
+	}
+}
 
-		bytes, readErr = ioutil.ReadAll(r)
-		if readErr != nil {
-			log.Fatal("Could not read compressed snapshot file %s: %s", file, readErr)
-		}
+// Store snapshot file in catalog, and in index if configured.
+func StoreSnapshot(file string) {
+	Catalog().Store(file)
+	if Index() != nil {
+		Index().Add(filepath.Base(file))
+	}
+}
+
+// Load headers of every snapshot, from index if configured. A snapshot that
+// fails verification is loaded anyway, with its Corruption set, so callers
+// decide what to do with it.
+func LoadSnapshots() (snapshots []Snapshot) {
+	if Index() != nil {
+		log.Info("Loading snapshots from index.")
+		snapshots = Index().Snapshots()
 	} else {
-		bytes, readErr = ioutil.ReadFile(file)
-		if readErr != nil {
-			log.Fatal("Could not read snapshot file '%s': %s", file, readErr)
+		log.Info("Loading snapshots")
+		for _, file := range SnapshotFiles() {
+			snapshots = append(snapshots, loadSnapshot(file))
 		}
 	}
-	err := json.Unmarshal(bytes, &snapshot)
-	if err != nil {
-		log.Fatal("Could not parse snapshot file '%s': %s", file, err)
+	for _, snapshot := range snapshots {
+		if snapshot.Corruption != nil {
+			log.Error("Snapshot file '%s' is CORRUPT: %s", snapshot.File, snapshot.Corruption)
+		}
+	}
+	return
+}
+
+// Load header of snapshot file. Versions are not loaded, iterate them with
+// ForEachVersion.
+func LoadSnapshot(file string) (snapshot Snapshot) {
+	snapshot = loadSnapshot(file)
+	if snapshot.Corruption != nil {
+		log.Fatal("Snapshot file '%s' is CORRUPT: %s", file, snapshot.Corruption)
 	}
+	return
+}
+
+// Same as LoadSnapshot, but a snapshot that fails verification is loaded
+// anyway, with its Corruption set.
+func LoadSnapshotLeniently(file string) Snapshot {
+	return loadSnapshot(file)
+}
+
+func loadSnapshot(file string) (snapshot Snapshot) {
+	log.Info("Loading snapshot file '%s'.", file)
 	snapshot.File = file
+	r, err := openSnapshot(file)
+	if err != nil {
+		exitOnKeyError(file, err)
+		snapshot.Corruption = err
+		return
+	}
+	r.Close()
+	snapshot.SnapshotHeader = r.Header
+	if !Cfg.SkipSnapshotVerification {
+		snapshot.Corruption = VerifySnapshot(file)
+		exitOnKeyError(file, snapshot.Corruption)
+	}
 	if Cfg.LogLevel > 0 {
 		pretty, _ := json.MarshalIndent(snapshot, "", "    ")
 		log.Debug("Snapshot '%s':\n%s", file, pretty)
@@ -124,6 +249,16 @@ func LoadSnapshot(file string) (snapshot Snapshot) {
 	return
 }
 
+// Exit when no key at hand decrypts snapshot file or a chunk of it, rather
+// than take the snapshot for corrupt, since gc would then drop the versions
+// only it references.
+func exitOnKeyError(file string, err error) {
+	var keyErr keyError
+	if errors.As(err, &keyErr) {
+		log.Fatal("Could not decrypt snapshot file '%s', configure its key: %s", file, err)
+	}
+}
+
 func ConfigureAws(region string) {
 	logLevelType := func(logLevel uint) aws.LogLevelType {
 		var awsLogLevel aws.LogLevelType
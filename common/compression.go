@@ -0,0 +1,197 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Codecs of snapshot files. Snapshot files are named after the codec they
+// are written with, but readers tell the codec by the magic bytes the file
+// starts with, so a file keeps its name when recompressed.
+const (
+	CompressionNone      = "none"
+	CompressionGzip      = "gzip"
+	CompressionZstd      = "zstd"
+)
+
+var (
+	compressionSuffixes  = map[string]string{CompressionNone: "", CompressionGzip: ".Z", CompressionZstd: ".zst"}
+	gzipMagic            = []byte{0x1f, 0x8b}
+	zstdMagic            = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Size of the blocks compressed in parallel by gzip.
+const gzipBlockSize = 1 << 20
+
+// Codec and level of new snapshot files. Without SnapshotCompression, snapshot
+// files are compressed by gzip when CompressSnapshots is set. Level 0 is the
+// default level of the codec.
+func ConfiguredCompression() (codec string, level int) {
+	switch {
+	case Cfg.BackupSet.SnapshotCompression != "":
+		return Cfg.BackupSet.SnapshotCompression, Cfg.BackupSet.SnapshotCompressionLevel
+	case Cfg.BackupSet.CompressSnapshots:
+		return CompressionGzip, Cfg.BackupSet.SnapshotCompressionLevel
+	}
+	return CompressionNone, 0
+}
+
+// Check compression configuration, exit when it is not valid.
+func CheckCompressionConfig() {
+	codec, level := ConfiguredCompression()
+	if err := CheckCompression(codec, level); err != nil {
+		log.Fatal("%s", err)
+	}
+}
+
+func CheckCompression(codec string, level int) error {
+	switch codec {
+	case CompressionNone:
+		if level != 0 {
+			return fmt.Errorf("Compression %s takes no level, got level %d.", codec, level)
+		}
+	case CompressionGzip:
+		if level < 0 || level > 9 {
+			return fmt.Errorf("Compression %s takes level 1 to 9, got level %d.", codec, level)
+		}
+	case CompressionZstd:
+		if level < 0 || level > 22 {
+			return fmt.Errorf("Compression %s takes level 1 to 22, got level %d.", codec, level)
+		}
+	default:
+		return fmt.Errorf("Unknown compression '%s', expected %s, %s or %s.", codec, CompressionNone, CompressionGzip, CompressionZstd)
+	}
+	return nil
+}
+
+// Suffix of names of snapshot files written with codec.
+func CompressionSuffix(codec string) string {
+	return compressionSuffixes[codec]
+}
+
+// Name of snapshot without the suffix of its codec.
+func TrimCompressionSuffix(name string) string {
+	for _, suffix := range compressionSuffixes {
+		if suffix != "" && strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+// Compress what is written to w with codec at level. Gzip and zstd
+// compress blocks in parallel on every CPU.
+func compressWriter(w io.Writer, codec string, level int) (io.WriteCloser, error) {
+	switch codec {
+	case CompressionGzip:
+		if level == 0 {
+			level = pgzip.DefaultCompression
+		}
+		gz, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		if err = gz.SetConcurrency(gzipBlockSize, runtime.NumCPU()); err != nil {
+			return nil, err
+		}
+		return gz, nil
+	case CompressionZstd:
+		options := []zstd.EOption{zstd.WithEncoderConcurrency(runtime.NumCPU())}
+		if level != 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, options...)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Decompress what is read from r by the codec its magic bytes tell.
+func decompressReader(r *bufio.Reader) (in io.ReadCloser, codec string, err error) {
+	magic, _ := r.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, CompressionGzip, fmt.Errorf("Could not initialize gzip decompressor: %s", err)
+		}
+		return gz, CompressionGzip, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, CompressionZstd, fmt.Errorf("Could not initialize zstd decompressor: %s", err)
+		}
+		return zr.IOReadCloser(), CompressionZstd, nil
+	}
+	return ioutil.NopCloser(r), CompressionNone, nil
+}
+
+// Rewrite snapshot file compressed by codec at level, unless it is
+// compressed by codec already and not forced. Return the codec the file was
+// compressed by. The file is verified first, so corruption is not carried
+// over, and encrypted as configured.
+func RecompressSnapshot(file string, codec string, level int, force bool) (from string, err error) {
+	if err = VerifySnapshot(file); err != nil {
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("Could not open file %s: %s", file, err)
+	}
+	defer f.Close()
+	in, _, from, err := snapshotStreamReader(f)
+	if err != nil {
+		return from, fmt.Errorf("Could not read snapshot file '%s': %s", file, err)
+	}
+	defer in.Close()
+	if from == codec && !force {
+		return
+	}
+	err = WriteFileAtomically(file, func(w io.Writer) error {
+		out, err := snapshotStreamWriter(w, codec, level)
+		if err != nil {
+			return fmt.Errorf("Could not recompress snapshot file %s: %s", file, err)
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			return fmt.Errorf("Could not recompress snapshot file %s: %s", file, err)
+		}
+		if err = out.Close(); err != nil {
+			return fmt.Errorf("Could not write compressed snapshot file %s: %s", file, err)
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Streams read back what was written to them, and their codec is told by
+// their magic bytes.
+func TestCompressionRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat("{\"Key\":\"ads/00001.jpg\",\"VersionId\":\"v0-00001\"}\n", 1000))
+	tests := []struct {
+		codec                string
+		level                int
+	}{
+		{CompressionNone, 0},
+		{CompressionGzip, 0},
+		{CompressionGzip, 1},
+		{CompressionGzip, 9},
+		{CompressionZstd, 0},
+		{CompressionZstd, 1},
+		{CompressionZstd, 19},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		out, err := snapshotStreamWriter(&buf, test.codec, test.level)
+		if err != nil {
+			t.Fatalf("%s level %d: %s", test.codec, test.level, err)
+		}
+		out.Write(payload)
+		if err = out.Close(); err != nil {
+			t.Fatalf("%s level %d: %s", test.codec, test.level, err)
+		}
+		if test.codec != CompressionNone && buf.Len() >= len(payload) {
+			t.Errorf("%s level %d: compressed %d bytes to %d.", test.codec, test.level, len(payload), buf.Len())
+		}
+
+		in, _, codec, err := snapshotStreamReader(&buf)
+		if err != nil {
+			t.Fatalf("%s level %d: %s", test.codec, test.level, err)
+		}
+		read, err := ioutil.ReadAll(in)
+		in.Close()
+		if codec != test.codec {
+			t.Errorf("%s level %d: detected codec %s.", test.codec, test.level, codec)
+		}
+		if err != nil || !bytes.Equal(read, payload) {
+			t.Errorf("%s level %d: read back %d bytes (%v), expected %d.", test.codec, test.level, len(read), err, len(payload))
+		}
+	}
+}
+
+// Snapshot files are recompressed only when their codec changes or when
+// forced, and keep their versions.
+func TestRecompressSnapshot(t *testing.T) {
+	tests := []struct {
+		from                 string
+		to                   string
+		level                int
+		force                bool
+		rewritten            bool
+	}{
+		{CompressionNone, CompressionGzip, 0, false, true},
+		{CompressionGzip, CompressionZstd, 0, false, true},
+		{CompressionZstd, CompressionNone, 0, false, true},
+		{CompressionZstd, CompressionZstd, 1, false, false},
+		{CompressionGzip, CompressionGzip, 1, true, true},
+	}
+	for _, test := range tests {
+		dir := setUpSnapshotsDir(t)
+		Cfg.BackupSet.SnapshotCompression = test.from
+		versions := testVersions(100, 0)
+		file := writeTestSnapshot(t, filepath.Join(dir, "snapshot"), versions)
+		before, _ := ioutil.ReadFile(file)
+
+		from, err := RecompressSnapshot(file, test.to, test.level, test.force)
+		if err != nil {
+			t.Fatalf("%s to %s: %s", test.from, test.to, err)
+		}
+		if from != test.from {
+			t.Errorf("%s to %s: snapshot was compressed by %s.", test.from, test.to, from)
+		}
+		after, _ := ioutil.ReadFile(file)
+		if rewritten := !bytes.Equal(before, after); rewritten != test.rewritten {
+			t.Errorf("%s to %s: rewritten is %t, expected %t.", test.from, test.to, rewritten, test.rewritten)
+		}
+		if codec := fileCodec(t, file); codec != test.to {
+			t.Errorf("%s to %s: snapshot is compressed by %s.", test.from, test.to, codec)
+		}
+		if err = VerifySnapshot(file); err != nil {
+			t.Errorf("%s to %s: %s", test.from, test.to, err)
+		}
+		if read := readVersions(file); !reflect.DeepEqual(read, versions) {
+			t.Errorf("%s to %s: read %d versions, expected %d.", test.from, test.to, len(read), len(versions))
+		}
+	}
+}
+
+func TestTrimCompressionSuffix(t *testing.T) {
+	tests := []struct {
+		name                 string
+		trimmed              string
+	}{
+		{"20150605152158-0500CDT", "20150605152158-0500CDT"},
+		{"20150605152158-0500CDT.Z", "20150605152158-0500CDT"},
+		{"20150605152158-0500CDT.zst", "20150605152158-0500CDT"},
+		{"20150605152158-0500CDT.gz", "20150605152158-0500CDT.gz"},
+	}
+	for _, test := range tests {
+		if trimmed := TrimCompressionSuffix(test.name); trimmed != test.trimmed {
+			t.Errorf("Trimmed '%s' to '%s', expected '%s'.", test.name, trimmed, test.trimmed)
+		}
+	}
+}
+
+func fileCodec(t *testing.T, file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("Could not open file %s: %s", file, err)
+	}
+	defer f.Close()
+	in, _, codec, err := snapshotStreamReader(f)
+	if err != nil {
+		t.Fatalf("Could not read file %s: %s", file, err)
+	}
+	in.Close()
+	return codec
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+)
+
+// Server-side encryption of the buckets of the backup set. Customer keys are
+// 256-bit keys encoded in base64.
+type EncryptionConfig struct {
+	SlaveSSECustomerKey  string
+	MasterServerSideEncryption string
+	MasterKMSKeyId       string
+	MasterSSECustomerKey string
+}
+
+// Encryption types recorded in snapshots.
+const (
+	EncryptionAES256     = "AES256"
+	EncryptionKMS        = "aws:kms"
+	EncryptionSSEC       = "SSE-C"
+)
+
+// Parameters of a request on an object encrypted with a customer key.
+type CustomerKey struct {
+	Algorithm            *string
+	Key                  *string
+	KeyMD5               *string
+}
+
+// Check encryption configuration, exit when it is not valid.
+func CheckEncryptionConfig() {
+	cfg := Cfg.BackupSet.Encryption
+	customerKey("SlaveSSECustomerKey", cfg.SlaveSSECustomerKey)
+	customerKey("MasterSSECustomerKey", cfg.MasterSSECustomerKey)
+	switch cfg.MasterServerSideEncryption {
+	case "", EncryptionAES256:
+	case EncryptionKMS:
+	case EncryptionSSEC:
+		if cfg.MasterSSECustomerKey == "" {
+			log.Fatal("MasterServerSideEncryption %s needs MasterSSECustomerKey.", EncryptionSSEC)
+		}
+	default:
+		log.Fatal("Unknown MasterServerSideEncryption '%s', expected one of '', %s, %s and %s.", cfg.MasterServerSideEncryption, EncryptionAES256, EncryptionKMS, EncryptionSSEC)
+	}
+	if cfg.MasterKMSKeyId != "" && cfg.MasterServerSideEncryption != EncryptionKMS {
+		log.Fatal("MasterKMSKeyId needs MasterServerSideEncryption %s.", EncryptionKMS)
+	}
+}
+
+// Whether server-side encryption is configured for the backup set, in which
+// case snapshots record the encryption of every version.
+func EncryptionConfigured() bool {
+	return Cfg.BackupSet.Encryption != EncryptionConfig{}
+}
+
+// Customer key for reading SSE-C objects from slave, nil when there is none.
+func SlaveCustomerKey() *CustomerKey {
+	return customerKey("SlaveSSECustomerKey", Cfg.BackupSet.Encryption.SlaveSSECustomerKey)
+}
+
+// Customer key for writing SSE-C objects to master, nil when master is not
+// configured for SSE-C.
+func MasterCustomerKey() *CustomerKey {
+	if Cfg.BackupSet.Encryption.MasterServerSideEncryption != EncryptionSSEC {
+		return nil
+	}
+	return customerKey("MasterSSECustomerKey", Cfg.BackupSet.Encryption.MasterSSECustomerKey)
+}
+
+// Server-side encryption and KMS key id for writing objects to master, nil
+// when master uses its default encryption or SSE-C.
+func MasterServerSideEncryption() (sse *string, kmsKeyId *string) {
+	cfg := Cfg.BackupSet.Encryption
+	switch cfg.MasterServerSideEncryption {
+	case EncryptionAES256:
+		sse = aws.String(EncryptionAES256)
+	case EncryptionKMS:
+		sse = aws.String(EncryptionKMS)
+		if cfg.MasterKMSKeyId != "" {
+			kmsKeyId = aws.String(cfg.MasterKMSKeyId)
+		}
+	}
+	return
+}
+
+func customerKey(field string, encoded string) *CustomerKey {
+	if encoded == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.Fatal("Could not decode %s from base64: %s", field, err)
+	}
+	if len(key) != 32 {
+		log.Fatal("%s is %d bytes long, expected a 256-bit key.", field, len(key))
+	}
+	sum := md5.Sum(key)
+	return &CustomerKey{
+		Algorithm: aws.String(EncryptionAES256),
+		Key: aws.String(string(key)),
+		KeyMD5: aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	}
+}
@@ -0,0 +1,381 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"path/filepath"
+	"time"
+)
+
+// The index is a database of the snapshots in catalog and their versions,
+// so that commands look up keys, versions and headers without reading
+// snapshot files. It holds three buckets. Bucket snapshots maps the name of
+// every snapshot to its header. Bucket versions holds one bucket per
+// snapshot that maps keys to their version in the snapshot, whole snapshots
+// for deltas. Bucket refs holds VersionId + "\x00" + name for every version
+// of every snapshot, so the snapshots referencing a version are found by
+// prefix.
+type SnapshotIndex struct {
+	db                   *bolt.DB
+}
+
+type indexedSnapshot struct {
+	Header               SnapshotHeader
+	Corruption           string `json:",omitempty"`
+	Versions             int64
+	Bytes                int64
+}
+
+var (
+	index                *SnapshotIndex
+	indexSnapshots       = []byte("snapshots")
+	indexVersions        = []byte("versions")
+	indexRefs            = []byte("refs")
+)
+
+// Index of backup set, brought up to date with the catalog when first
+// opened. Nil when no index is configured.
+func Index() *SnapshotIndex {
+	if index != nil || Cfg.BackupSet.IndexFile == "" {
+		return index
+	}
+	log.Info("Opening index %s.", Cfg.BackupSet.IndexFile)
+	db, err := bolt.Open(Cfg.BackupSet.IndexFile, 0644, &bolt.Options{Timeout: time.Minute})
+	if err != nil {
+		log.Fatal("Could not open index %s: %s", Cfg.BackupSet.IndexFile, err)
+	}
+	index = &SnapshotIndex{db: db}
+	index.update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{indexSnapshots, indexVersions, indexRefs} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	index.Sync()
+	return index
+}
+
+// Bring index up to date with catalog.
+func ImportIndex() {
+	if Cfg.BackupSet.IndexFile == "" {
+		log.Fatal("No index is configured, set IndexFile.")
+	}
+	log.Info("Index %s holds %d snapshots.", Cfg.BackupSet.IndexFile, len(Index().names()))
+}
+
+func (x *SnapshotIndex) update(fn func(*bolt.Tx) error) {
+	if err := x.db.Update(fn); err != nil {
+		log.Fatal("Could not update index %s: %s", Cfg.BackupSet.IndexFile, err)
+	}
+}
+
+func (x *SnapshotIndex) view(fn func(*bolt.Tx) error) {
+	if err := x.db.View(fn); err != nil {
+		log.Fatal("Could not read index %s: %s", Cfg.BackupSet.IndexFile, err)
+	}
+}
+
+// Import snapshots of catalog missing from index, and remove from index
+// snapshots gone from catalog. Snapshots indexed as corrupt are verified
+// and imported again, since they may have been repaired or fetched whole
+// since.
+func (x *SnapshotIndex) Sync() {
+	names := Catalog().List()
+	inCatalog := make(map[string]bool)
+	for _, name := range names {
+		inCatalog[name] = true
+	}
+	indexed := x.names()
+	for name := range indexed {
+		if !inCatalog[name] {
+			log.Info("Removing snapshot '%s' from index, it is gone from catalog.", name)
+			x.Remove(name)
+		}
+	}
+	corrupt := x.corrupt()
+	for _, name := range names {
+		if corrupt[name] {
+			log.Info("Verifying snapshot '%s' again, it is indexed as corrupt.", name)
+			x.Remove(name)
+			x.Add(name)
+		} else if !indexed[name] {
+			x.Add(name)
+		}
+	}
+}
+
+// Names of snapshots indexed as corrupt.
+func (x *SnapshotIndex) corrupt() map[string]bool {
+	names := make(map[string]bool)
+	x.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexSnapshots).ForEach(func(k, v []byte) error {
+			var record indexedSnapshot
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("Could not decode header of snapshot '%s': %s", k, err)
+			}
+			if record.Corruption != "" {
+				names[string(k)] = true
+			}
+			return nil
+		})
+	})
+	return names
+}
+
+func (x *SnapshotIndex) names() map[string]bool {
+	names := make(map[string]bool)
+	x.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexSnapshots).ForEach(func(k, v []byte) error {
+			names[string(k)] = true
+			return nil
+		})
+	})
+	return names
+}
+
+// Import snapshot of catalog into index, unless it is there. Versions are
+// imported in batches of IndexBatchSize and the header last, so a snapshot
+// whose import was interrupted is imported again.
+func (x *SnapshotIndex) Add(name string) {
+	if x.names()[name] {
+		return
+	}
+	x.Remove(name)
+	file := Catalog().Fetch(name)
+	snapshot := loadSnapshot(file)
+	record := indexedSnapshot{Header: snapshot.SnapshotHeader}
+	if snapshot.Corruption != nil {
+		log.Error("Snapshot file '%s' is CORRUPT, indexing only its header: %s", file, snapshot.Corruption)
+		record.Corruption = snapshot.Corruption.Error()
+	} else {
+		log.Info("Indexing snapshot '%s'.", name)
+		var batch []Version
+		ForEachVersion(file, func(version Version) {
+			batch = append(batch, version)
+			if !version.DeleteMarker {
+				record.Versions++
+				record.Bytes += version.Size
+			}
+			if len(batch) == IndexBatchSize {
+				x.putVersions(name, batch)
+				batch = batch[:0]
+			}
+		})
+		x.putVersions(name, batch)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Fatal("Could not encode header of snapshot '%s': %s", name, err)
+	}
+	x.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexSnapshots).Put([]byte(name), data)
+	})
+}
+
+func (x *SnapshotIndex) putVersions(name string, batch []Version) {
+	x.update(func(tx *bolt.Tx) error {
+		versions, err := tx.Bucket(indexVersions).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		refs := tx.Bucket(indexRefs)
+		for _, version := range batch {
+			data, err := json.Marshal(version)
+			if err != nil {
+				return fmt.Errorf("Could not encode version %s of key '%s': %s", version.VersionId, version.Key, err)
+			}
+			if err = versions.Put([]byte(version.Key), data); err != nil {
+				return err
+			}
+			if err = refs.Put(refKey(version.VersionId, name), []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func refKey(versionId string, name string) []byte {
+	return []byte(versionId + "\x00" + name)
+}
+
+// Remove snapshot from index, in batches of IndexBatchSize versions.
+func (x *SnapshotIndex) Remove(name string) {
+	x.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexSnapshots).Delete([]byte(name))
+	})
+	for done := false; !done; {
+		x.update(func(tx *bolt.Tx) error {
+			versions := tx.Bucket(indexVersions).Bucket([]byte(name))
+			if versions == nil {
+				done = true
+				return nil
+			}
+			var keys [][]byte
+			var versionIds []string
+			c := versions.Cursor()
+			for k, v := c.First(); k != nil && len(keys) < IndexBatchSize; k, v = c.Next() {
+				var version Version
+				if err := json.Unmarshal(v, &version); err != nil {
+					return fmt.Errorf("Could not decode version of key '%s' in snapshot '%s': %s", k, name, err)
+				}
+				keys = append(keys, append([]byte(nil), k...))
+				versionIds = append(versionIds, version.VersionId)
+			}
+			if len(keys) == 0 {
+				done = true
+				return tx.Bucket(indexVersions).DeleteBucket([]byte(name))
+			}
+			refs := tx.Bucket(indexRefs)
+			for i := range keys {
+				if err := versions.Delete(keys[i]); err != nil {
+					return err
+				}
+				if err := refs.Delete(refKey(versionIds[i], name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// Replace header of snapshot in index.
+func (x *SnapshotIndex) SetHeader(name string, header SnapshotHeader) {
+	x.update(func(tx *bolt.Tx) error {
+		snapshots := tx.Bucket(indexSnapshots)
+		var record indexedSnapshot
+		if v := snapshots.Get([]byte(name)); v != nil {
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("Could not decode header of snapshot '%s': %s", name, err)
+			}
+		}
+		record.Header = header
+		data, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("Could not encode header of snapshot '%s': %s", name, err)
+		}
+		return snapshots.Put([]byte(name), data)
+	})
+}
+
+// Headers of every snapshot in index. Files of snapshots are where the
+// catalog caches them, whether they are there or not.
+func (x *SnapshotIndex) Snapshots() (snapshots []Snapshot) {
+	x.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexSnapshots).ForEach(func(k, v []byte) error {
+			var record indexedSnapshot
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("Could not decode header of snapshot '%s': %s", k, err)
+			}
+			snapshot := Snapshot{File: filepath.Join(Cfg.BackupSet.SnapshotsDir, string(k)), SnapshotHeader: record.Header}
+			if record.Corruption != "" {
+				snapshot.Corruption = errors.New(record.Corruption)
+			}
+			snapshots = append(snapshots, snapshot)
+			return nil
+		})
+	})
+	return
+}
+
+// Header of snapshot in index.
+func (x *SnapshotIndex) Snapshot(name string) (snapshot Snapshot, ok bool) {
+	for _, s := range x.Snapshots() {
+		if filepath.Base(s.File) == name {
+			return s, true
+		}
+	}
+	return
+}
+
+// Count and total size of keys of snapshot, deltas included and delete
+// markers excluded.
+func (x *SnapshotIndex) Totals(name string) (count int64, size int64) {
+	x.view(func(tx *bolt.Tx) error {
+		var record indexedSnapshot
+		if v := tx.Bucket(indexSnapshots).Get([]byte(name)); v != nil {
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("Could not decode header of snapshot '%s': %s", name, err)
+			}
+		}
+		count, size = record.Versions, record.Bytes
+		return nil
+	})
+	return
+}
+
+// Version of key in snapshot.
+func (x *SnapshotIndex) Lookup(name string, key string) (version Version, ok bool) {
+	x.view(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(indexVersions).Bucket([]byte(name))
+		if versions == nil {
+			return nil
+		}
+		v := versions.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(v, &version)
+	})
+	return
+}
+
+// Call fn for every version of snapshot whose key starts with prefix, in
+// key order. An empty prefix walks every version of the snapshot.
+func (x *SnapshotIndex) ForEachVersion(name string, prefix string, fn func(Version)) {
+	x.view(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(indexVersions).Bucket([]byte(name))
+		if versions == nil {
+			return nil
+		}
+		c := versions.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var version Version
+			if err := json.Unmarshal(v, &version); err != nil {
+				return fmt.Errorf("Could not decode version of key '%s' in snapshot '%s': %s", k, name, err)
+			}
+			fn(version)
+		}
+		return nil
+	})
+}
+
+// Names of snapshots referencing version.
+func (x *SnapshotIndex) Referencing(versionId string) (names []string) {
+	prefix := refKey(versionId, "")
+	x.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(indexRefs).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			names = append(names, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	return
+}
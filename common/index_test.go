@@ -0,0 +1,121 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Versions of indexed snapshots are found by key and by version id.
+func TestIndexLookupAndReferencing(t *testing.T) {
+	dir := setUpSnapshotsDir(t)
+	Cfg.BackupSet.IndexFile = filepath.Join(dir, ".index.db")
+	older := testVersions(10, 0)
+	newer := append(testVersions(5, 0), testVersions(10, 1)[5:]...)
+	writeTestSnapshot(t, filepath.Join(dir, "older"), older)
+	writeTestSnapshot(t, filepath.Join(dir, "newer"), newer)
+	x := Index()
+
+	lookups := []struct {
+		snapshot             string
+		key                  string
+		version              Version
+		ok                   bool
+	}{
+		{"older", "ads/00007.jpg", older[7], true},
+		{"newer", "ads/00007.jpg", newer[7], true},
+		{"newer", "ads/00003.jpg", older[3], true},
+		{"newer", "ads/00010.jpg", Version{}, false},
+		{"missing", "ads/00003.jpg", Version{}, false},
+	}
+	for _, test := range lookups {
+		version, ok := x.Lookup(test.snapshot, test.key)
+		if ok != test.ok || !reflect.DeepEqual(version, test.version) {
+			t.Errorf("Lookup of '%s' in %s gave %+v, %t, expected %+v, %t.", test.key, test.snapshot, version, ok, test.version, test.ok)
+		}
+	}
+
+	references := []struct {
+		versionId            string
+		names                []string
+	}{
+		{"v0-00003", []string{"newer", "older"}},
+		{"v0-00007", []string{"older"}},
+		{"v1-00007", []string{"newer"}},
+		{"v1-00003", nil},
+	}
+	for _, test := range references {
+		if names := x.Referencing(test.versionId); !reflect.DeepEqual(names, test.names) {
+			t.Errorf("Version %s is referenced by %v, expected %v.", test.versionId, names, test.names)
+		}
+	}
+
+	var prefixed []Version
+	x.ForEachVersion("newer", "ads/0000", func(version Version) {
+		prefixed = append(prefixed, version)
+	})
+	if !reflect.DeepEqual(prefixed, newer) {
+		t.Errorf("Versions of 'newer' under 'ads/0000' are %+v, expected %+v.", prefixed, newer)
+	}
+	if count, size := x.Totals("older"); count != 10 || size != 45 {
+		t.Errorf("Totals of 'older' are %d keys of %d bytes, expected 10 keys of 45 bytes.", count, size)
+	}
+}
+
+// Sync drops snapshots gone from catalog, and indexes again the versions of
+// snapshots repaired since they were indexed as corrupt.
+func TestIndexSync(t *testing.T) {
+	dir := setUpSnapshotsDir(t)
+	Cfg.BackupSet.IndexFile = filepath.Join(dir, ".index.db")
+	versions := testVersions(10, 0)
+	gone := writeTestSnapshot(t, filepath.Join(dir, "gone"), versions)
+	broken := writeTestSnapshot(t, filepath.Join(dir, "broken"), versions)
+	info, _ := os.Stat(broken)
+	if err := os.Truncate(broken, info.Size()/2); err != nil {
+		t.Fatalf("Could not truncate snapshot: %s", err)
+	}
+	x := Index()
+
+	if snapshot, ok := x.Snapshot("broken"); !ok || snapshot.Corruption == nil {
+		t.Errorf("Truncated snapshot is indexed as %+v, %t, expected corrupt.", snapshot, ok)
+	}
+	if _, ok := x.Lookup("broken", "ads/00003.jpg"); ok {
+		t.Errorf("Versions of corrupt snapshot are indexed.")
+	}
+
+	os.Remove(gone)
+	writeTestSnapshot(t, broken, versions)
+	x.Sync()
+
+	if _, ok := x.Snapshot("gone"); ok {
+		t.Errorf("Removed snapshot is still indexed.")
+	}
+	if names := x.Referencing("v0-00003"); !reflect.DeepEqual(names, []string{"broken"}) {
+		t.Errorf("Version v0-00003 is referenced by %v, expected [broken].", names)
+	}
+	if snapshot, ok := x.Snapshot("broken"); !ok || snapshot.Corruption != nil {
+		t.Errorf("Repaired snapshot is indexed as %+v, %t, expected sound.", snapshot, ok)
+	}
+	if version, ok := x.Lookup("broken", "ads/00003.jpg"); !ok || !reflect.DeepEqual(version, versions[3]) {
+		t.Errorf("Lookup in repaired snapshot gave %+v, %t, expected %+v.", version, ok, versions[3])
+	}
+}
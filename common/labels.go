@@ -0,0 +1,128 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Labels name snapshots besides their timestamp, e.g. pre-migration. They
+// start with a letter and hold only letters, digits, dots, dashes and
+// underscores, so they are never taken for names of snapshots or for other
+// selectors.
+var labelPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9._-]*$`)
+
+func CheckLabel(label string) error {
+	if !labelPattern.MatchString(label) || label == "latest" {
+		return fmt.Errorf("Invalid label '%s', labels start with a letter, hold only letters, digits, '.', '-' and '_', and are not 'latest'.", label)
+	}
+	return nil
+}
+
+// Whether snapshot carries label.
+func (h SnapshotHeader) HasLabel(label string) bool {
+	for _, l := range h.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrite header of snapshot in catalog by fn, and store the snapshot in
+// catalog and index again. Return the new header.
+func UpdateSnapshotHeader(name string, fn func(*SnapshotHeader)) SnapshotHeader {
+	file := Catalog().Fetch(name)
+	header, err := rewriteSnapshotHeader(file, fn)
+	if err != nil {
+		log.Fatal("%s", err)
+	}
+	Catalog().Store(file)
+	if Index() != nil {
+		Index().SetHeader(name, header)
+	}
+	return header
+}
+
+// Rewrite header of snapshot file by fn. Versions are carried over as they
+// are, since the digest of the header covers them and not the header, and
+// the file keeps its codec. The file is verified first, so corruption is not
+// carried over.
+func rewriteSnapshotHeader(file string, fn func(*SnapshotHeader)) (header SnapshotHeader, err error) {
+	if err = VerifySnapshot(file); err != nil {
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return header, fmt.Errorf("Could not open file %s: %s", file, err)
+	}
+	defer f.Close()
+	in, _, codec, err := snapshotStreamReader(f)
+	if err != nil {
+		return header, fmt.Errorf("Could not read snapshot file '%s': %s", file, err)
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return header, fmt.Errorf("Could not read snapshot file '%s': %s", file, err)
+	}
+	if json.Unmarshal(line, &header) != nil || header.Format < SnapshotFormat {
+		return header, fmt.Errorf("Snapshot file '%s' is of format %d, which has no header to rewrite.", file, LegacySnapshotFormat)
+	}
+
+	fn(&header)
+	level := 0
+	if configured, configuredLevel := ConfiguredCompression(); configured == codec {
+		level = configuredLevel
+	}
+	log.Info("Rewriting header of snapshot file '%s'.", filepath.Base(file))
+	err = writeSnapshotFile(file, header, br, codec, level)
+	return
+}
+
+// Names of snapshots carrying label, read from the index when configured.
+func labeledSnapshots(label string, names []string) (labeled []string) {
+	if Index() != nil {
+		for _, snapshot := range Index().Snapshots() {
+			if snapshot.HasLabel(label) {
+				labeled = append(labeled, filepath.Base(snapshot.File))
+			}
+		}
+		return
+	}
+	for _, name := range names {
+		r, err := openSnapshot(Catalog().Fetch(name))
+		if err != nil {
+			log.Error("Ignoring snapshot '%s': %s", name, err)
+			continue
+		}
+		if r.Header.HasLabel(label) {
+			labeled = append(labeled, name)
+		}
+		r.Close()
+	}
+	return
+}
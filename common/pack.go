@@ -0,0 +1,310 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The pack store keeps the lines of deduplicated snapshots in chunks named
+// after the SHA-256 digest of their lines. Snapshots are sorted by key and
+// cut into chunks after lines whose hash is a multiple of
+// ChunkAverageRecords, so a chunk only changes when one of its own versions
+// changes, and consecutive snapshots of a bucket share most of their chunks.
+// Chunks are compressed by gzip, encrypted like snapshot files and live in
+// directory PackDir of the catalog. Their names are not encrypted, so who
+// reads the catalog may confirm a guess of the whole contents of a chunk.
+// Keying the names instead would take a secret the snapshot host lacks
+// with an age recipient, and renaming every chunk on rekey.
+const PackDir = "packs"
+
+// Reference to a chunk, one per line of a deduplicated snapshot file.
+type chunkRef struct {
+	Chunk                string
+}
+
+// Reader of the lines of the chunks referenced by a deduplicated snapshot
+// file, one chunk after another. Every chunk is checked against its name
+// once read.
+type chunkReader struct {
+	file                 string
+	refs                 *json.Decoder
+	id                   string
+	f                    *os.File
+	gz                   io.ReadCloser
+	hash                 hash.Hash
+	in                   io.Reader
+}
+
+// Path to local copy of chunk.
+func chunkFile(id string) string {
+	return filepath.Join(Cfg.BackupSet.SnapshotsDir, PackDir, id)
+}
+
+func (c *chunkReader) Read(p []byte) (n int, err error) {
+	for {
+		if c.in == nil {
+			if !c.refs.More() {
+				return 0, io.EOF
+			}
+			var ref chunkRef
+			if err = c.refs.Decode(&ref); err != nil {
+				return 0, fmt.Errorf("Could not parse snapshot file '%s': %s", c.file, err)
+			}
+			if err = c.open(ref.Chunk); err != nil {
+				return 0, err
+			}
+		}
+		n, err = c.in.Read(p)
+		if err != io.EOF {
+			return
+		}
+		sum := hex.EncodeToString(c.hash.Sum(nil))
+		id := c.id
+		c.close()
+		if sum != id {
+			return n, fmt.Errorf("Chunk %s of snapshot file '%s' is corrupt: found digest %s.", id, c.file, sum)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (c *chunkReader) open(id string) (err error) {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("Snapshot file '%s' references invalid chunk '%s'.", c.file, id)
+	}
+	c.id = id
+	c.f, c.gz, err = openChunk(Catalog().FetchChunk(id))
+	if err != nil {
+		return fmt.Errorf("Could not read chunk %s of snapshot file '%s': %w", id, c.file, err)
+	}
+	c.hash = sha256.New()
+	c.in = io.TeeReader(c.gz, c.hash)
+	return nil
+}
+
+// Open chunk file, decrypted and decompressed.
+func openChunk(file string) (f *os.File, in io.ReadCloser, err error) {
+	f, err = os.Open(file)
+	if err != nil {
+		return
+	}
+	in, _, codec, err := snapshotStreamReader(f)
+	if err == nil && codec != CompressionGzip {
+		err = fmt.Errorf("chunk is not compressed by gzip")
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return
+}
+
+// Check chunk file against the name of its chunk.
+func verifyChunk(id string, file string) error {
+	f, in, err := openChunk(file)
+	if err != nil {
+		return fmt.Errorf("Could not read chunk %s: %s", id, err)
+	}
+	defer f.Close()
+	defer in.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, in); err != nil {
+		return fmt.Errorf("Could not read chunk %s: %s", id, err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != id {
+		return fmt.Errorf("Chunk %s is corrupt: found digest %s.", id, sum)
+	}
+	return nil
+}
+
+func (c *chunkReader) close() {
+	if c.in != nil {
+		c.gz.Close()
+		c.f.Close()
+		c.in = nil
+	}
+}
+
+// Sort versions of spool file by key, store them in chunks of pack store
+// and return the references to the chunks along with the digest of the
+// lines of the versions.
+func packVersions(spoolFile string) (refs *bytes.Buffer, digest string) {
+	sorted := sortVersions(spoolFile, ByKey, forEachSpooledVersion)
+	defer sorted.Close()
+
+	refs = new(bytes.Buffer)
+	enc := json.NewEncoder(refs)
+	digestHash := sha256.New()
+	var chunk bytes.Buffer
+	records := 0
+	flush := func() {
+		if err := enc.Encode(chunkRef{Chunk: storeChunk(chunk.Bytes())}); err != nil {
+			log.Fatal("Could not encode chunk reference: %s", err)
+		}
+		chunk.Reset()
+		records = 0
+	}
+	for version, ok := sorted.Next(); ok; version, ok = sorted.Next() {
+		line, err := json.Marshal(version)
+		if err != nil {
+			log.Fatal("Could not encode version %s of key '%s': %s", version.VersionId, version.Key, err)
+		}
+		line = append(line, '\n')
+		chunk.Write(line)
+		digestHash.Write(line)
+		records++
+		if isChunkBoundary(line) || records == ChunkMaxRecords {
+			flush()
+		}
+	}
+	if records > 0 {
+		flush()
+	}
+	return refs, "sha256:" + hex.EncodeToString(digestHash.Sum(nil))
+}
+
+func isChunkBoundary(line []byte) bool {
+	h := fnv.New32a()
+	h.Write(line)
+	return h.Sum32() % ChunkAverageRecords == 0
+}
+
+// Store lines in pack store, unless a chunk with the same lines is there
+// already, and return the name of their chunk.
+func storeChunk(lines []byte) (id string) {
+	sum := sha256.Sum256(lines)
+	id = hex.EncodeToString(sum[:])
+	file := chunkFile(id)
+	if _, err := os.Stat(file); err == nil {
+		// Reused chunks look recent, here and in catalog, so gc does not
+		// take them for unreferenced while the snapshot file is not
+		// stored yet.
+		now := time.Now()
+		os.Chtimes(file, now, now)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			log.Fatal("Could not create pack store %s: %s", filepath.Dir(file), err)
+		}
+		err := WriteFileAtomically(file, func(f io.Writer) error {
+			gz, err := snapshotStreamWriter(f, CompressionGzip, 0)
+			if err != nil {
+				return fmt.Errorf("Could not write chunk %s: %s", id, err)
+			}
+			if _, err := gz.Write(lines); err != nil {
+				return fmt.Errorf("Could not write chunk %s: %s", id, err)
+			}
+			if err := gz.Close(); err != nil {
+				return fmt.Errorf("Could not write chunk %s: %s", id, err)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal("%s", err)
+		}
+	}
+	Catalog().StoreChunk(file)
+	return
+}
+
+func forEachSpooledVersion(file string, fn func(Version)) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal("Could not open spool file %s: %s", file, err)
+	}
+	defer f.Close()
+	in, err := tempFileReader(f)
+	if err != nil {
+		log.Fatal("Could not read spool file %s: %s", file, err)
+	}
+	dec := json.NewDecoder(in)
+	for dec.More() {
+		var version Version
+		if err := dec.Decode(&version); err != nil {
+			log.Fatal("Could not read spool file %s: %s", file, err)
+		}
+		fn(version)
+	}
+}
+
+// Names of the chunks referenced by snapshot file, none unless it is
+// deduplicated.
+func SnapshotChunks(file string) (ids []string, err error) {
+	r, err := openSnapshot(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if r.chunks == nil {
+		return nil, nil
+	}
+	for r.chunks.refs.More() {
+		var ref chunkRef
+		if err = r.chunks.refs.Decode(&ref); err != nil {
+			return nil, fmt.Errorf("Could not parse snapshot file '%s': %s", file, err)
+		}
+		ids = append(ids, ref.Chunk)
+	}
+	return
+}
+
+// Remove chunks of pack store that no snapshot in catalog references.
+// Chunks younger than a day are left alone, since a snapshot in progress
+// stores its chunks before its snapshot file.
+func RemoveUnreferencedChunks() {
+	chunks := Catalog().ListChunks()
+	if len(chunks) == 0 {
+		return
+	}
+	referenced := make(map[string]bool)
+	for _, name := range Catalog().List() {
+		ids, err := SnapshotChunks(Catalog().Fetch(name))
+		if err != nil {
+			log.Error("Could not read chunks of snapshot '%s', keeping every chunk: %s", name, err)
+			return
+		}
+		for _, id := range ids {
+			referenced[id] = true
+		}
+	}
+
+	removed := 0
+	for id, modified := range chunks {
+		if referenced[id] || time.Since(modified) < 24 * time.Hour {
+			continue
+		}
+		log.Debug("Removing unreferenced chunk %s.", id)
+		Catalog().RemoveChunk(id)
+		removed++
+	}
+	log.Info("Removed %d of %d chunks from pack store.", removed, len(chunks))
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Deduplicated snapshots read back the versions they were written with,
+// sorted by key, whatever their count of chunks.
+func TestPackedSnapshotRoundTrip(t *testing.T) {
+	tests := []struct {
+		name                 string
+		versions             []Version
+		minChunks            int
+	}{
+		{name: "empty", versions: nil, minChunks: 0},
+		{name: "one chunk", versions: testVersions(10, 0), minChunks: 1},
+		{name: "several chunks", versions: testVersions(5000, 0), minChunks: 2},
+		{name: "unsorted with delete marker", versions: append(testVersions(3, 0), Version{Key: "a/deleted", VersionId: "dm", DeleteMarker: true, LastModified: testTime}), minChunks: 1},
+	}
+	for _, test := range tests {
+		dir := setUpSnapshotsDir(t)
+		Cfg.BackupSet.DeduplicateSnapshots = true
+		file := writeTestSnapshot(t, filepath.Join(dir, "packed"), test.versions)
+
+		r := OpenSnapshot(file)
+		format := r.Header.Format
+		r.Close()
+		if format != PackedSnapshotFormat {
+			t.Errorf("%s: snapshot is of format %d, expected %d.", test.name, format, PackedSnapshotFormat)
+		}
+		if err := VerifySnapshot(file); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if read := readVersions(file); !reflect.DeepEqual(read, sortedByKey(test.versions)) {
+			t.Errorf("%s: read %+v, expected %+v.", test.name, read, sortedByKey(test.versions))
+		}
+		ids, err := SnapshotChunks(file)
+		if err != nil || len(ids) < test.minChunks {
+			t.Errorf("%s: snapshot references %d chunks (%v), expected at least %d.", test.name, len(ids), err, test.minChunks)
+		}
+	}
+}
+
+// Snapshots that differ in one version share every chunk but the one or two
+// around that version.
+func TestPackedSnapshotsShareChunks(t *testing.T) {
+	dir := setUpSnapshotsDir(t)
+	Cfg.BackupSet.DeduplicateSnapshots = true
+	versions := testVersions(5000, 0)
+	first := writeTestSnapshot(t, filepath.Join(dir, "first"), versions)
+	versions[2500].VersionId = "changed"
+	second := writeTestSnapshot(t, filepath.Join(dir, "second"), versions)
+
+	firstIds, _ := SnapshotChunks(first)
+	secondIds, _ := SnapshotChunks(second)
+	shared := make(map[string]bool)
+	for _, id := range firstIds {
+		shared[id] = true
+	}
+	fresh := 0
+	for _, id := range secondIds {
+		if !shared[id] {
+			fresh++
+		}
+	}
+	if fresh == 0 || fresh > 2 {
+		t.Errorf("Second snapshot has %d chunks the first has not, of %d, expected 1 or 2.", fresh, len(secondIds))
+	}
+}
+
+// A snapshot is corrupt when a chunk it references is missing or does not
+// match its name.
+func TestPackedSnapshotDetectsBrokenChunks(t *testing.T) {
+	tests := []struct {
+		name                 string
+		breakChunk           func(file string) error
+	}{
+		{"missing chunk", os.Remove},
+		{"chunk of other lines", func(file string) error {
+			other := writeChunkOf("{\"Key\":\"other\"}\n")
+			return os.Rename(other, file)
+		}},
+		{"truncated chunk", func(file string) error {
+			return os.Truncate(file, 10)
+		}},
+	}
+	for _, test := range tests {
+		dir := setUpSnapshotsDir(t)
+		Cfg.BackupSet.DeduplicateSnapshots = true
+		file := writeTestSnapshot(t, filepath.Join(dir, "packed"), testVersions(100, 0))
+		ids, _ := SnapshotChunks(file)
+		if err := test.breakChunk(chunkFile(ids[0])); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if err := VerifySnapshot(file); err == nil {
+			t.Errorf("%s: snapshot verifies.", test.name)
+		}
+	}
+}
+
+var testTime = time.Date(2015, 6, 5, 15, 21, 58, 0, time.UTC)
+
+// Fresh snapshots directory with a local catalog and neither index nor
+// encryption, set back when the test ends. Fatal errors fail the test.
+func setUpSnapshotsDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "backup-my-bucket-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	saved, fatal := Cfg, log.Fatal
+	Cfg.BackupSet = BackupSet{SnapshotsDir: dir, SlaveBucket: "images-slave"}
+	catalog, index = nil, nil
+	snapshotRecipient, snapshotIdentities, snapshotPassphrases = nil, nil, nil
+	log.Fatal = t.Fatalf
+	t.Cleanup(func() {
+		if index != nil {
+			index.db.Close()
+		}
+		catalog, index = nil, nil
+		snapshotRecipient, snapshotIdentities, snapshotPassphrases = nil, nil, nil
+		Cfg, log.Fatal = saved, fatal
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// Versions of count keys, at version ids of given generation.
+func testVersions(count int, generation int) (versions []Version) {
+	for i := 0; i < count; i++ {
+		versions = append(versions, Version{
+			Key:          fmt.Sprintf("ads/%05d.jpg", i),
+			VersionId:    fmt.Sprintf("v%d-%05d", generation, i),
+			Size:         int64(i),
+			LastModified: testTime,
+		})
+	}
+	return
+}
+
+func writeTestSnapshot(t *testing.T, file string, versions []Version) string {
+	return writeTestSnapshotAt(t, file, versions, testTime)
+}
+
+func writeTestSnapshotAt(t *testing.T, file string, versions []Version, timestamp time.Time) string {
+	w := CreateSnapshot(file)
+	for _, version := range versions {
+		w.Write(version)
+	}
+	w.Close(SnapshotHeader{Bucket: "images-slave", Timestamp: timestamp})
+	return file
+}
+
+func readVersions(file string) (versions []Version) {
+	ForEachVersion(file, func(version Version) {
+		versions = append(versions, version)
+	})
+	return
+}
+
+func sortedByKey(versions []Version) []Version {
+	sorted := append([]Version(nil), versions...)
+	sort.Sort(versionSorter{sorted, ByKey})
+	if len(sorted) == 0 {
+		return nil
+	}
+	return sorted
+}
+
+// Store lines as a chunk and return the path to the chunk file.
+func writeChunkOf(lines string) string {
+	return chunkFile(storeChunk([]byte(lines)))
+}
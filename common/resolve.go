@@ -0,0 +1,175 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type namedSnapshot struct {
+	name                 string
+	timestamp            time.Time
+}
+
+type byNewest []namedSnapshot
+
+// Path to local copy of the snapshot given by selector. See
+// ResolveSnapshot.
+func FetchSnapshot(selector string) string {
+	return Catalog().Fetch(ResolveSnapshot(selector))
+}
+
+// Name of the snapshot in catalog given by selector, which is one of
+//
+//   latest       the newest snapshot
+//   latest~N     the Nth snapshot before the newest one
+//   @DATE        the newest snapshot taken before DATE, e.g. @2015-06-05
+//   @TIME        the newest snapshot taken at or before TIME, e.g.
+//                @2015-06-05T15:21:58-05:00
+//   NAME         the snapshot of given name, with its suffix of codec or
+//                without any
+//   PREFIX       the one snapshot whose name starts with PREFIX
+//   LABEL        the one snapshot carrying LABEL, unless a name matches
+//
+// Exit when no snapshot or more than one snapshot matches.
+func ResolveSnapshot(selector string) string {
+	name, err := resolveSnapshot(selector, Catalog().List())
+	if err != nil {
+		log.Fatal("%s", err)
+	}
+	if name != selector {
+		log.Info("Snapshot '%s' is '%s'.", selector, name)
+	}
+	return name
+}
+
+func resolveSnapshot(selector string, names []string) (string, error) {
+	if selector == "" {
+		return "", fmt.Errorf("No snapshot was given.")
+	}
+	if selector == "latest" || strings.HasPrefix(selector, "latest~") {
+		n := 0
+		if selector != "latest" {
+			var err error
+			n, err = strconv.Atoi(strings.TrimPrefix(selector, "latest~"))
+			if err != nil || n < 0 {
+				return "", fmt.Errorf("Could not parse snapshot '%s', expected latest~N for N a non-negative integer.", selector)
+			}
+		}
+		snapshots := snapshotTimes(names)
+		if n >= len(snapshots) {
+			return "", fmt.Errorf("There is no snapshot '%s', only %d snapshots are in catalog.", selector, len(snapshots))
+		}
+		return snapshots[n].name, nil
+	}
+	if strings.HasPrefix(selector, "@") {
+		return resolveTime(selector, names)
+	}
+
+	for _, name := range names {
+		if name == selector {
+			return name, nil
+		}
+	}
+	// A suffix of codec in selector must match exactly, so a selector never
+	// resolves to a file of another codec.
+	base := TrimCompressionSuffix(selector)
+	var exact, prefixed []string
+	for _, name := range names {
+		if TrimCompressionSuffix(name) == base {
+			if base != selector {
+				return "", fmt.Errorf("There is no snapshot '%s' in catalog, but there is '%s'.", selector, name)
+			}
+			exact = append(exact, name)
+		}
+		if strings.HasPrefix(name, selector) {
+			prefixed = append(prefixed, name)
+		}
+	}
+	switch {
+	case len(exact) == 1:
+		return exact[0], nil
+	case len(exact) > 1:
+		return "", fmt.Errorf("Snapshot '%s' is ambiguous, it may be any of %s.", selector, strings.Join(exact, ", "))
+	case len(prefixed) == 1:
+		return prefixed[0], nil
+	case len(prefixed) > 1:
+		return "", fmt.Errorf("Snapshot '%s' is ambiguous, it is a prefix of %s.", selector, strings.Join(prefixed, ", "))
+	}
+	if CheckLabel(selector) == nil {
+		labeled := labeledSnapshots(selector, names)
+		switch {
+		case len(labeled) == 1:
+			return labeled[0], nil
+		case len(labeled) > 1:
+			return "", fmt.Errorf("Label '%s' is ambiguous, it is on snapshots %s.", selector, strings.Join(labeled, ", "))
+		}
+	}
+	return "", fmt.Errorf("There is no snapshot '%s' in catalog.", selector)
+}
+
+// Resolve @DATE to the newest snapshot before the day begins in local
+// time, and @TIME to the newest snapshot at or before the given time.
+func resolveTime(selector string, names []string) (string, error) {
+	value := strings.TrimPrefix(selector, "@")
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		day, dayErr := time.ParseInLocation("2006-01-02", value, time.Local)
+		if dayErr != nil {
+			return "", fmt.Errorf("Could not parse snapshot '%s', expected @2006-01-02 or @2006-01-02T15:04:05-07:00.", selector)
+		}
+		at = day.Add(-time.Nanosecond)
+	}
+	for _, snapshot := range snapshotTimes(names) {
+		if !snapshot.timestamp.After(at) {
+			return snapshot.name, nil
+		}
+	}
+	return "", fmt.Errorf("There is no snapshot '%s', every snapshot in catalog is newer.", selector)
+}
+
+// Timestamps of snapshots, newest first. The timestamp comes from the name
+// of the snapshot when it is named after SnapshotNameLayout, and from its
+// header otherwise.
+func snapshotTimes(names []string) (snapshots []namedSnapshot) {
+	for _, name := range names {
+		timestamp, err := time.Parse(SnapshotNameLayout, TrimCompressionSuffix(name))
+		if err != nil {
+			r, openErr := openSnapshot(Catalog().Fetch(name))
+			if openErr != nil {
+				log.Error("Ignoring snapshot '%s': %s", name, openErr)
+				continue
+			}
+			timestamp = r.Header.Timestamp
+			r.Close()
+		}
+		snapshots = append(snapshots, namedSnapshot{name, timestamp})
+	}
+	sort.Sort(byNewest(snapshots))
+	return
+}
+
+func (s byNewest) Len() int           { return len(s) }
+func (s byNewest) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNewest) Less(i, j int) bool { return s[i].timestamp.After(s[j].timestamp) }
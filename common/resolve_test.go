@@ -0,0 +1,97 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveSnapshot(t *testing.T) {
+	dir := setUpSnapshotsDir(t)
+	defer func(local *time.Location) {
+		time.Local = local
+	}(time.Local)
+	time.Local = time.UTC
+	cdt := time.FixedZone("CDT", -5 * 60 * 60)
+	snapshots := []struct {
+		name                 string
+		timestamp            time.Time
+		labels               []string
+	}{
+		{"20150601120000-0500CDT.Z", time.Date(2015, 6, 1, 12, 0, 0, 0, cdt), []string{"monthly"}},
+		{"20150603120000-0500CDT.Z", time.Date(2015, 6, 3, 12, 0, 0, 0, cdt), []string{"weekly"}},
+		{"manual", time.Date(2015, 6, 4, 12, 0, 0, 0, cdt), []string{"weekly", "audit"}},
+		{"20150605152158-0500CDT.zst", time.Date(2015, 6, 5, 15, 21, 58, 0, cdt), nil},
+		{"20150605160000-0500CDT", time.Date(2015, 6, 5, 16, 0, 0, 0, cdt), nil},
+	}
+	var names []string
+	for _, s := range snapshots {
+		w := CreateSnapshot(filepath.Join(dir, s.name))
+		w.Close(SnapshotHeader{Bucket: "images-slave", Timestamp: s.timestamp, Labels: s.labels})
+		names = append(names, s.name)
+	}
+
+	tests := []struct {
+		selector             string
+		name                 string
+		err                  string
+	}{
+		{"", "", "No snapshot was given"},
+		{"latest", "20150605160000-0500CDT", ""},
+		{"latest~0", "20150605160000-0500CDT", ""},
+		{"latest~1", "20150605152158-0500CDT.zst", ""},
+		{"latest~2", "manual", ""},
+		{"latest~4", "20150601120000-0500CDT.Z", ""},
+		{"latest~5", "", "only 5 snapshots"},
+		{"latest~-1", "", "Could not parse"},
+		{"latest~one", "", "Could not parse"},
+		{"@2015-06-04", "20150603120000-0500CDT.Z", ""},
+		{"@2015-06-05", "manual", ""},
+		{"@2015-06-05T15:21:58-05:00", "20150605152158-0500CDT.zst", ""},
+		{"@2015-06-05T15:21:57-05:00", "manual", ""},
+		{"@2015-06-05T20:21:58Z", "20150605152158-0500CDT.zst", ""},
+		{"@2015-05-01", "", "every snapshot in catalog is newer"},
+		{"@yesterday", "", "Could not parse"},
+		{"20150605160000-0500CDT", "20150605160000-0500CDT", ""},
+		{"20150605152158-0500CDT.zst", "20150605152158-0500CDT.zst", ""},
+		{"20150605152158-0500CDT", "20150605152158-0500CDT.zst", ""},
+		{"20150605152158-0500CDT.Z", "", "but there is '20150605152158-0500CDT.zst'"},
+		{"2015060516", "20150605160000-0500CDT", ""},
+		{"man", "manual", ""},
+		{"2015060", "", "ambiguous"},
+		{"monthly", "20150601120000-0500CDT.Z", ""},
+		{"audit", "manual", ""},
+		{"weekly", "", "Label 'weekly' is ambiguous"},
+		{"yearly", "", "There is no snapshot 'yearly'"},
+	}
+	for _, test := range tests {
+		name, err := resolveSnapshot(test.selector, names)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("Selector '%s': %s", test.selector, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("Selector '%s' gave '%s', %v, expected error '%s'.", test.selector, name, err, test.err)
+		case name != test.name:
+			t.Errorf("Selector '%s' gave '%s', expected '%s'.", test.selector, name, test.name)
+		}
+	}
+}
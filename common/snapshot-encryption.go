@@ -0,0 +1,583 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"filippo.io/age"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Encryption of snapshot files and chunks at rest, on the host and in
+// catalog. Files are encrypted after they are compressed, either by age to
+// an X25519 recipient, or by AES-256-GCM under a key derived from a
+// passphrase by scrypt and HKDF. Reading age files takes the identity of the
+// recipient, found in IdentityFile.
+type SnapshotEncryptionConfig struct {
+	Recipient            string
+	IdentityFile         string
+	Passphrase           string
+}
+
+// Encryption schemes of snapshot files. Readers tell the scheme by the
+// magic bytes the file starts with, so files encrypted by another scheme or
+// not encrypted at all remain readable as long as their key is at hand.
+const (
+	SnapshotEncryptionNone       = "none"
+	SnapshotEncryptionAge        = "age"
+	SnapshotEncryptionPassphrase = "aes-256-gcm"
+)
+
+// Files encrypted under a passphrase start with passphraseMagic, the base 2
+// logarithm of the scrypt cost, the random salt of the master key and the
+// random salt of the file. Scrypt derives the master key from the
+// passphrase and its salt, which every process draws once for the files it
+// writes, and HKDF derives the key of every file from the master key and
+// the salt of the file. So every file has its own key, no table of
+// precomputed master keys applies to any two deployments, and scrypt runs
+// once per process rather than once per file. The rest of the file is a
+// sequence of segments of passphraseSegmentSize bytes of plaintext sealed
+// by AES-256-GCM. The nonce
+// of a segment is its number followed by a byte telling whether it is the
+// last segment, so segments cannot be reordered and truncation is detected.
+// The header is authenticated along with every segment.
+const (
+	passphraseSegmentSize = 64 * 1024
+	passphraseSaltSize    = 16
+	passphraseLogCost     = 15
+	passphraseMaxLogCost  = 22
+)
+
+var (
+	ageMagic             = []byte("age-encryption.org/v1\n")
+	passphraseMagic      = []byte("backup-my-bucket/aes-256-gcm/v1\n")
+	snapshotRecipient    *age.X25519Recipient
+	snapshotIdentities   []age.Identity
+	snapshotPassphrases  []string
+	masterKeySalt        []byte
+	masterKeys           = make(map[string][]byte)
+	masterKeysLock       sync.Mutex
+	tempKey              []byte
+)
+
+// Scheme of new snapshot files.
+func ConfiguredEncryption() string {
+	cfg := Cfg.BackupSet.SnapshotEncryption
+	switch {
+	case cfg.Recipient != "":
+		return SnapshotEncryptionAge
+	case cfg.Passphrase != "":
+		return SnapshotEncryptionPassphrase
+	}
+	return SnapshotEncryptionNone
+}
+
+// Check encryption configuration of snapshot files and load its keys, exit
+// when it is not valid.
+func CheckSnapshotEncryptionConfig() {
+	cfg := Cfg.BackupSet.SnapshotEncryption
+	if cfg.Recipient != "" && cfg.Passphrase != "" {
+		log.Fatal("SnapshotEncryption takes either Recipient or Passphrase, not both.")
+	}
+	if SnapshotEncryptionConfigured() && Cfg.BackupSet.IndexFile != "" {
+		log.Fatal("The index holds keys of the bucket in the clear, IndexFile does not go with SnapshotEncryption.")
+	}
+	if cfg.Recipient != "" {
+		recipient, err := age.ParseX25519Recipient(cfg.Recipient)
+		if err != nil {
+			log.Fatal("Could not parse Recipient of SnapshotEncryption: %s", err)
+		}
+		snapshotRecipient = recipient
+	}
+	if cfg.IdentityFile != "" {
+		if err := AddSnapshotIdentities(cfg.IdentityFile); err != nil {
+			log.Fatal("%s", err)
+		}
+	}
+	if cfg.Passphrase != "" {
+		AddSnapshotPassphrase(cfg.Passphrase)
+	}
+}
+
+// Read age identities from file to decrypt snapshot files with.
+func AddSnapshotIdentities(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("Could not open identity file %s: %s", file, err)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return fmt.Errorf("Could not parse identity file %s: %s", file, err)
+	}
+	snapshotIdentities = append(snapshotIdentities, identities...)
+	return nil
+}
+
+// Add passphrase to decrypt snapshot files with.
+func AddSnapshotPassphrase(passphrase string) {
+	snapshotPassphrases = append(snapshotPassphrases, passphrase)
+}
+
+// Whether any key of SnapshotEncryption is configured, in which case the
+// keys of the bucket are not to be stored in the clear.
+func SnapshotEncryptionConfigured() bool {
+	return Cfg.BackupSet.SnapshotEncryption != SnapshotEncryptionConfig{}
+}
+
+// Check that the configured keys decrypt what they encrypt, so files are
+// not rewritten under a key nobody can read.
+func CheckSnapshotKeys() error {
+	var encrypted bytes.Buffer
+	w, err := encryptWriter(&encrypted)
+	if err != nil {
+		return err
+	}
+	probe := []byte("backup-my-bucket\n")
+	w.Write(probe)
+	if err = w.Close(); err != nil {
+		return err
+	}
+	r, _, err := decryptReader(bufio.NewReader(&encrypted))
+	if err != nil {
+		return fmt.Errorf("Configured keys could not decrypt what they encrypt: %s", err)
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(decrypted, probe) {
+		return fmt.Errorf("Configured keys could not decrypt what they encrypt: %v", err)
+	}
+	return nil
+}
+
+// Encrypt what is written to w as configured.
+func encryptWriter(w io.Writer) (io.WriteCloser, error) {
+	switch ConfiguredEncryption() {
+	case SnapshotEncryptionAge:
+		return age.Encrypt(w, snapshotRecipient)
+	case SnapshotEncryptionPassphrase:
+		return newPassphraseWriter(w, Cfg.BackupSet.SnapshotEncryption.Passphrase)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// Error of a file that no key at hand decrypts. Such a file is not known to
+// be corrupt, it is merely unreadable here.
+type keyError struct {
+	error
+}
+
+// Decrypt what is read from r by the scheme its magic bytes tell, with any
+// key at hand.
+func decryptReader(r *bufio.Reader) (in io.Reader, scheme string, err error) {
+	magic, _ := r.Peek(len(passphraseMagic))
+	switch {
+	case bytes.HasPrefix(magic, ageMagic):
+		if len(snapshotIdentities) == 0 {
+			return nil, SnapshotEncryptionAge, keyError{errors.New("File is encrypted by age, configure IdentityFile of SnapshotEncryption to read it.")}
+		}
+		in, err = age.Decrypt(r, snapshotIdentities...)
+		if err != nil {
+			return nil, SnapshotEncryptionAge, keyError{fmt.Errorf("Could not decrypt by age: %s", err)}
+		}
+		return in, SnapshotEncryptionAge, nil
+	case bytes.HasPrefix(magic, passphraseMagic):
+		if len(snapshotPassphrases) == 0 {
+			return nil, SnapshotEncryptionPassphrase, keyError{errors.New("File is encrypted under a passphrase, configure Passphrase of SnapshotEncryption to read it.")}
+		}
+		in, err = newPassphraseReader(r)
+		return in, SnapshotEncryptionPassphrase, err
+	}
+	return r, SnapshotEncryptionNone, nil
+}
+
+// Writer of the contents of a snapshot file or chunk, compressed by codec at
+// level and then encrypted as configured.
+func snapshotStreamWriter(w io.Writer, codec string, level int) (io.WriteCloser, error) {
+	enc, err := encryptWriter(w)
+	if err != nil {
+		return nil, fmt.Errorf("Could not initialize encryption: %s", err)
+	}
+	out, err := compressWriter(enc, codec, level)
+	if err != nil {
+		return nil, fmt.Errorf("Could not initialize %s compressor: %s", codec, err)
+	}
+	return layeredWriteCloser{out, enc}, nil
+}
+
+type layeredWriteCloser struct {
+	io.WriteCloser
+	under                io.Closer
+}
+
+func (w layeredWriteCloser) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.under.Close()
+}
+
+// Reader of the contents of a snapshot file or chunk, decrypted and then
+// decompressed.
+func snapshotStreamReader(r io.Reader) (in io.ReadCloser, scheme string, codec string, err error) {
+	plain, scheme, err := decryptReader(bufio.NewReader(r))
+	if err != nil {
+		return
+	}
+	in, codec, err = decompressReader(bufio.NewReader(plain))
+	return
+}
+
+// Rewrite file encrypted as configured, under a fresh key, and return the
+// scheme it was encrypted by. Compressed contents are carried over as they
+// are. Files neither encrypted nor to be encrypted are left alone.
+func rekeyFile(file string) (from string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("Could not open file %s: %s", file, err)
+	}
+	defer f.Close()
+	in, from, err := decryptReader(bufio.NewReader(f))
+	if err != nil {
+		return from, fmt.Errorf("Could not read file %s: %s", file, err)
+	}
+	if from == SnapshotEncryptionNone && ConfiguredEncryption() == SnapshotEncryptionNone {
+		return
+	}
+	err = WriteFileAtomically(file, func(w io.Writer) error {
+		out, err := encryptWriter(w)
+		if err != nil {
+			return fmt.Errorf("Could not initialize encryption of %s: %s", file, err)
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			return fmt.Errorf("Could not decrypt file %s: %s", file, err)
+		}
+		if err = out.Close(); err != nil {
+			return fmt.Errorf("Could not write encrypted file %s: %s", file, err)
+		}
+		return nil
+	})
+	return
+}
+
+// Rewrite snapshot file encrypted as configured. The file is verified
+// first, so corruption is not carried over.
+func RekeySnapshot(file string) (from string, err error) {
+	if err = VerifySnapshot(file); err != nil {
+		return
+	}
+	return rekeyFile(file)
+}
+
+// Rewrite chunk of pack store encrypted as configured and store it in
+// catalog over the previous one. The chunk is verified first.
+func RekeyChunk(id string) (from string, err error) {
+	file := Catalog().FetchChunk(id)
+	if err = verifyChunk(id, file); err != nil {
+		return
+	}
+	if from, err = rekeyFile(file); err != nil {
+		return
+	}
+	if from != SnapshotEncryptionNone || ConfiguredEncryption() != SnapshotEncryptionNone {
+		Catalog().ReplaceChunk(file)
+	}
+	return
+}
+
+func newPassphraseWriter(w io.Writer, passphrase string) (io.WriteCloser, error) {
+	keySalt, err := processKeySalt()
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(nil), passphraseMagic...), passphraseLogCost)
+	header = append(append(header, keySalt...), salt...)
+	aead, err := passphraseCipher(passphrase, passphraseLogCost, keySalt, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &passphraseWriter{w: w, aead: aead, header: header, buf: make([]byte, 0, passphraseSegmentSize)}, nil
+}
+
+func newPassphraseReader(r *bufio.Reader) (io.Reader, error) {
+	header := make([]byte, len(passphraseMagic) + 1 + 2 * passphraseSaltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("Could not read encryption header: %s", err)
+	}
+	logCost := header[len(passphraseMagic)]
+	if logCost > passphraseMaxLogCost {
+		return nil, fmt.Errorf("Encryption header asks for scrypt cost 2^%d, at most 2^%d is supported.", logCost, passphraseMaxLogCost)
+	}
+	keySalt := header[len(passphraseMagic) + 1:len(passphraseMagic) + 1 + passphraseSaltSize]
+	salt := header[len(passphraseMagic) + 1 + passphraseSaltSize:]
+	p := &passphraseReader{r: r, header: header, segment: make([]byte, passphraseSegmentSize + 16)}
+
+	// The passphrase is the one that opens the first segment.
+	if err := p.readSegment(); err != nil {
+		return nil, err
+	}
+	for _, passphrase := range snapshotPassphrases {
+		aead, err := passphraseCipher(passphrase, logCost, keySalt, salt)
+		if err != nil {
+			return nil, err
+		}
+		p.aead = aead
+		if err = p.open(); err == nil {
+			return p, nil
+		}
+	}
+	return nil, keyError{errors.New("No configured passphrase decrypts file, or file is corrupt.")}
+}
+
+// AES-256-GCM under key derived from master key of passphrase and salt of
+// file.
+func passphraseCipher(passphrase string, logCost byte, keySalt []byte, salt []byte) (cipher.AEAD, error) {
+	master, err := masterKey(passphrase, logCost, keySalt)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, master, salt, passphraseMagic), key); err != nil {
+		return nil, fmt.Errorf("Could not derive key of file: %s", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Spool files and sorted runs hold keys of the bucket. With SnapshotEncryption
+// they are sealed like files encrypted under a passphrase, under a random key
+// that only lives in memory, so those left by a crash are unreadable. They
+// start with the salt of their own key.
+func tempFileWriter(w io.Writer) (io.WriteCloser, error) {
+	if !SnapshotEncryptionConfigured() {
+		return nopWriteCloser{w}, nil
+	}
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := tempFileCipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &passphraseWriter{w: w, aead: aead, header: salt, buf: make([]byte, 0, passphraseSegmentSize)}, nil
+}
+
+// Reader of temporary file written by tempFileWriter.
+func tempFileReader(r io.Reader) (io.Reader, error) {
+	if !SnapshotEncryptionConfigured() {
+		return r, nil
+	}
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, fmt.Errorf("Could not read temporary file: %s", err)
+	}
+	aead, err := tempFileCipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &passphraseReader{r: bufio.NewReader(r), aead: aead, header: salt, segment: make([]byte, passphraseSegmentSize + 16)}, nil
+}
+
+func tempFileCipher(salt []byte) (cipher.AEAD, error) {
+	masterKeysLock.Lock()
+	if tempKey == nil {
+		tempKey = make([]byte, 32)
+		if _, err := rand.Read(tempKey); err != nil {
+			masterKeysLock.Unlock()
+			return nil, err
+		}
+	}
+	masterKeysLock.Unlock()
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, tempKey, salt, []byte("backup-my-bucket/temporary")), key); err != nil {
+		return nil, fmt.Errorf("Could not derive key of temporary file: %s", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Salt of the master keys of the files this process writes.
+func processKeySalt() ([]byte, error) {
+	masterKeysLock.Lock()
+	defer masterKeysLock.Unlock()
+	if masterKeySalt == nil {
+		salt := make([]byte, passphraseSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		masterKeySalt = salt
+	}
+	return masterKeySalt, nil
+}
+
+// Key derived from passphrase and salt by scrypt at cost 2^logCost, once
+// per salt, cost and passphrase.
+func masterKey(passphrase string, logCost byte, salt []byte) ([]byte, error) {
+	masterKeysLock.Lock()
+	defer masterKeysLock.Unlock()
+	id := fmt.Sprintf("%x\x00%d\x00%s", salt, logCost, passphrase)
+	if key, ok := masterKeys[id]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1 << logCost, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Could not derive key from passphrase: %s", err)
+	}
+	masterKeys[id] = key
+	return key, nil
+}
+
+func segmentNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type passphraseWriter struct {
+	w                    io.Writer
+	aead                 cipher.AEAD
+	header               []byte
+	counter              uint64
+	buf                  []byte
+	out                  []byte
+}
+
+func (p *passphraseWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		// A full segment is sealed once more data follows, since the
+		// last segment is sealed on Close.
+		if len(p.buf) == passphraseSegmentSize {
+			if err = p.seal(false); err != nil {
+				return
+			}
+		}
+		m := copy(p.buf[len(p.buf):passphraseSegmentSize], b)
+		p.buf = p.buf[:len(p.buf) + m]
+		b = b[m:]
+		n += m
+	}
+	return
+}
+
+func (p *passphraseWriter) seal(last bool) error {
+	p.out = p.aead.Seal(p.out[:0], segmentNonce(p.counter, last), p.buf, p.header)
+	p.counter++
+	p.buf = p.buf[:0]
+	_, err := p.w.Write(p.out)
+	return err
+}
+
+func (p *passphraseWriter) Close() error {
+	return p.seal(true)
+}
+
+type passphraseReader struct {
+	r                    *bufio.Reader
+	aead                 cipher.AEAD
+	header               []byte
+	counter              uint64
+	segment              []byte
+	sealed               []byte
+	last                 bool
+	plain                []byte
+	unread               []byte
+}
+
+func (p *passphraseReader) Read(b []byte) (n int, err error) {
+	for len(p.unread) == 0 {
+		if p.last {
+			return 0, io.EOF
+		}
+		if err = p.readSegment(); err != nil {
+			return
+		}
+		if err = p.open(); err != nil {
+			return
+		}
+	}
+	n = copy(b, p.unread)
+	p.unread = p.unread[n:]
+	return
+}
+
+// Read next segment, telling whether it is the last by whether any data
+// follows.
+func (p *passphraseReader) readSegment() error {
+	n, err := io.ReadFull(p.r, p.segment)
+	switch err {
+	case nil:
+		if _, err = p.r.Peek(1); err == io.EOF {
+			p.last = true
+		} else if err != nil {
+			return fmt.Errorf("Could not read encrypted file: %s", err)
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		p.last = true
+	default:
+		return fmt.Errorf("Could not read encrypted file: %s", err)
+	}
+	if n < 16 {
+		return errors.New("Encrypted file is truncated.")
+	}
+	p.sealed = p.segment[:n]
+	return nil
+}
+
+func (p *passphraseReader) open() (err error) {
+	p.plain, err = p.aead.Open(p.plain[:0], segmentNonce(p.counter, p.last), p.sealed, p.header)
+	if err != nil {
+		return fmt.Errorf("Could not decrypt segment %d of encrypted file, it is corrupt or truncated.", p.counter)
+	}
+	p.counter++
+	p.unread = p.plain
+	return nil
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"filippo.io/age"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Size of a sealed segment of a file encrypted under a passphrase, and of
+// the header before the first.
+const (
+	testSealedSegmentSize = passphraseSegmentSize + 16
+	testPassphraseHeader  = 65
+)
+
+// Files read back what was written to them, whatever their size and
+// scheme.
+func TestSnapshotEncryptionRoundTrip(t *testing.T) {
+	identity := generateIdentity(t)
+	sizes := []int{0, 1, passphraseSegmentSize - 1, passphraseSegmentSize, passphraseSegmentSize + 1, 200 * 1024}
+	tests := []struct {
+		scheme               string
+		config               SnapshotEncryptionConfig
+		magic                []byte
+	}{
+		{SnapshotEncryptionNone, SnapshotEncryptionConfig{}, nil},
+		{SnapshotEncryptionAge, SnapshotEncryptionConfig{Recipient: identity.Recipient().String()}, ageMagic},
+		{SnapshotEncryptionPassphrase, SnapshotEncryptionConfig{Passphrase: "correct horse battery staple"}, passphraseMagic},
+	}
+	for _, test := range tests {
+		setUpSnapshotEncryption(t, test.config, identity)
+		for _, size := range sizes {
+			plain := testPayload(size)
+			sealed := encryptPayload(t, plain)
+			if !bytes.HasPrefix(sealed, test.magic) {
+				t.Errorf("%s, %d bytes: file starts with %q.", test.scheme, size, sealed[:len(test.magic)])
+			}
+			read, scheme, err := decryptPayload(sealed)
+			if scheme != test.scheme {
+				t.Errorf("%s, %d bytes: detected scheme %s.", test.scheme, size, scheme)
+			}
+			if err != nil || !bytes.Equal(read, plain) {
+				t.Errorf("%s, %d bytes: read back %d bytes (%v).", test.scheme, size, len(read), err)
+			}
+		}
+	}
+}
+
+// Files that no key at hand decrypts give a keyError, telling them apart
+// from corrupt files.
+func TestSnapshotEncryptionWrongKey(t *testing.T) {
+	identity, other := generateIdentity(t), generateIdentity(t)
+	tests := []struct {
+		name                 string
+		writer               SnapshotEncryptionConfig
+		reader               SnapshotEncryptionConfig
+		identity             *age.X25519Identity
+	}{
+		{"age without identity", SnapshotEncryptionConfig{Recipient: identity.Recipient().String()}, SnapshotEncryptionConfig{}, nil},
+		{"age with other identity", SnapshotEncryptionConfig{Recipient: identity.Recipient().String()}, SnapshotEncryptionConfig{}, other},
+		{"passphrase without passphrase", SnapshotEncryptionConfig{Passphrase: "right"}, SnapshotEncryptionConfig{}, nil},
+		{"passphrase with other passphrase", SnapshotEncryptionConfig{Passphrase: "right"}, SnapshotEncryptionConfig{Passphrase: "wrong"}, nil},
+	}
+	for _, test := range tests {
+		setUpSnapshotEncryption(t, test.writer, identity)
+		sealed := encryptPayload(t, testPayload(1000))
+		setUpSnapshotEncryption(t, test.reader, test.identity)
+		_, _, err := decryptPayload(sealed)
+		var keyErr keyError
+		if !errors.As(err, &keyErr) {
+			t.Errorf("%s: got error %v, expected a key error.", test.name, err)
+		}
+	}
+}
+
+// Files encrypted under a passphrase that are truncated, reordered or
+// altered do not read back.
+func TestPassphraseSegmentTampering(t *testing.T) {
+	tests := []struct {
+		name                 string
+		tamper               func(sealed []byte) []byte
+	}{
+		{"last segment dropped", func(sealed []byte) []byte {
+			return sealed[:testPassphraseHeader + 3 * testSealedSegmentSize]
+		}},
+		{"two last segments dropped", func(sealed []byte) []byte {
+			return sealed[:testPassphraseHeader + 2 * testSealedSegmentSize]
+		}},
+		{"cut within segment", func(sealed []byte) []byte {
+			return sealed[:len(sealed) - 100]
+		}},
+		{"segments swapped", func(sealed []byte) []byte {
+			second := testPassphraseHeader + testSealedSegmentSize
+			third := second + testSealedSegmentSize
+			swapped := append([]byte(nil), sealed[:second]...)
+			swapped = append(swapped, sealed[third:third + testSealedSegmentSize]...)
+			swapped = append(swapped, sealed[second:third]...)
+			return append(swapped, sealed[third + testSealedSegmentSize:]...)
+		}},
+		{"segment altered", func(sealed []byte) []byte {
+			sealed[testPassphraseHeader + testSealedSegmentSize + 10] ^= 1
+			return sealed
+		}},
+		{"salt altered", func(sealed []byte) []byte {
+			sealed[testPassphraseHeader - 1] ^= 1
+			return sealed
+		}},
+	}
+	for _, test := range tests {
+		setUpSnapshotEncryption(t, SnapshotEncryptionConfig{Passphrase: "correct horse battery staple"}, nil)
+		plain := testPayload(3 * passphraseSegmentSize + 1000)
+		sealed := test.tamper(encryptPayload(t, plain))
+		if read, _, err := decryptPayload(sealed); err == nil {
+			t.Errorf("%s: read back %d bytes of %d without error.", test.name, len(read), len(plain))
+		}
+	}
+}
+
+// Configured keys are checked to read what they write.
+func TestCheckSnapshotKeys(t *testing.T) {
+	identity, other := generateIdentity(t), generateIdentity(t)
+	tests := []struct {
+		name                 string
+		config               SnapshotEncryptionConfig
+		identity             *age.X25519Identity
+		ok                   bool
+	}{
+		{"none", SnapshotEncryptionConfig{}, nil, true},
+		{"age", SnapshotEncryptionConfig{Recipient: identity.Recipient().String()}, identity, true},
+		{"age without identity", SnapshotEncryptionConfig{Recipient: identity.Recipient().String()}, nil, false},
+		{"age with other identity", SnapshotEncryptionConfig{Recipient: identity.Recipient().String()}, other, false},
+		{"passphrase", SnapshotEncryptionConfig{Passphrase: "right"}, nil, true},
+	}
+	for _, test := range tests {
+		setUpSnapshotEncryption(t, test.config, test.identity)
+		if err := CheckSnapshotKeys(); (err == nil) != test.ok {
+			t.Errorf("%s: got error %v.", test.name, err)
+		}
+	}
+}
+
+// Encrypted snapshot files read back their versions and hold no key in the
+// clear.
+func TestEncryptedSnapshotRoundTrip(t *testing.T) {
+	identity := generateIdentity(t)
+	tests := []struct {
+		name                 string
+		config               SnapshotEncryptionConfig
+		deduplicate          bool
+	}{
+		{"age", SnapshotEncryptionConfig{Recipient: identity.Recipient().String()}, false},
+		{"passphrase", SnapshotEncryptionConfig{Passphrase: "right"}, false},
+		{"age deduplicated", SnapshotEncryptionConfig{Recipient: identity.Recipient().String()}, true},
+	}
+	for _, test := range tests {
+		dir := setUpSnapshotEncryption(t, test.config, identity)
+		Cfg.BackupSet.DeduplicateSnapshots = test.deduplicate
+		versions := testVersions(2000, 0)
+		file := writeTestSnapshot(t, filepath.Join(dir, "snapshot"), versions)
+
+		if err := VerifySnapshot(file); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if read := readVersions(file); !reflect.DeepEqual(read, versions) {
+			t.Errorf("%s: read %d versions, expected %d.", test.name, len(read), len(versions))
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+		for _, f := range append(files, file) {
+			if data, _ := ioutil.ReadFile(f); bytes.Contains(data, []byte("ads/00001.jpg")) {
+				t.Errorf("%s: file %s holds a key in the clear.", test.name, f)
+			}
+		}
+	}
+}
+
+// Set up a snapshots directory encrypting as configured, able to decrypt
+// with the configured passphrase and identity, if any.
+func setUpSnapshotEncryption(t *testing.T, config SnapshotEncryptionConfig, identity *age.X25519Identity) string {
+	dir := setUpSnapshotsDir(t)
+	Cfg.BackupSet.SnapshotEncryption = config
+	if config.Recipient != "" {
+		recipient, err := age.ParseX25519Recipient(config.Recipient)
+		if err != nil {
+			t.Fatalf("Could not parse recipient: %s", err)
+		}
+		snapshotRecipient = recipient
+	}
+	if identity != nil {
+		snapshotIdentities = []age.Identity{identity}
+	}
+	if config.Passphrase != "" {
+		AddSnapshotPassphrase(config.Passphrase)
+	}
+	return dir
+}
+
+func generateIdentity(t *testing.T) *age.X25519Identity {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Could not generate identity: %s", err)
+	}
+	return identity
+}
+
+func testPayload(size int) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i * 7 + i / 251)
+	}
+	return payload
+}
+
+func encryptPayload(t *testing.T, plain []byte) []byte {
+	var sealed bytes.Buffer
+	w, err := encryptWriter(&sealed)
+	if err != nil {
+		t.Fatalf("Could not initialize encryption: %s", err)
+	}
+	if _, err = w.Write(plain); err != nil {
+		t.Fatalf("Could not encrypt: %s", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Could not encrypt: %s", err)
+	}
+	return sealed.Bytes()
+}
+
+func decryptPayload(sealed []byte) (plain []byte, scheme string, err error) {
+	in, scheme, err := decryptReader(bufio.NewReader(bytes.NewReader(sealed)))
+	if err != nil {
+		return
+	}
+	plain, err = ioutil.ReadAll(in)
+	return
+}
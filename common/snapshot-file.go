@@ -0,0 +1,476 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Snapshot files of format 2 and above consist of a header line followed by
+// one line per version, each line being a JSON document. The header tells
+// where the snapshot comes from, how many versions follow and the SHA-256
+// digest of the lines that follow. Snapshot files of format 1 are a single
+// JSON document holding every version in field Contents. Snapshot files of
+// format 3 are deltas: their lines are the versions of the keys that changed
+// since the snapshot named by Parent in header, and the snapshot consists
+// of these versions over the versions of its parent. Snapshot files of
+// format 4 are deduplicated: their lines reference chunks of the pack store,
+// which hold the lines of the versions sorted by key.
+const (
+	LegacySnapshotFormat = 1
+	SnapshotFormat       = 2
+	DeltaSnapshotFormat  = 3
+	PackedSnapshotFormat = 4
+)
+
+// Spool and temporary files live in the snapshots directory while a snapshot
+// file is being written. They are hidden so they are never taken for
+// snapshots.
+const TempFilePrefix = ".tmp-"
+
+type SnapshotReader struct {
+	Header               SnapshotHeader
+	file                 string
+	f                    *os.File
+	in                   io.ReadCloser
+	dec                  *json.Decoder
+	body                 io.Reader
+	chunks               *chunkReader
+	hash                 hash.Hash
+	count                int64
+}
+
+type SnapshotWriter struct {
+	File                 string
+	spoolFile            string
+	spool                *os.File
+	buf                  *bufio.Writer
+	sealed               io.WriteCloser
+	enc                  *json.Encoder
+	hash                 hash.Hash
+	keyCount             int64
+	deleteMarkerCount    int64
+	totalBytes           int64
+}
+
+// Open snapshot file and read its header. Versions are read one at a time
+// by means of Next.
+func OpenSnapshot(file string) (r *SnapshotReader) {
+	r, err := openSnapshot(file)
+	if err != nil {
+		log.Fatal("%s", err)
+	}
+	return
+}
+
+func openSnapshot(file string) (r *SnapshotReader, err error) {
+	r = &SnapshotReader{file: file}
+	r.f, err = os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open file %s: %s", file, err)
+	}
+
+	r.in, _, _, err = snapshotStreamReader(r.f)
+	if err != nil {
+		r.f.Close()
+		return nil, fmt.Errorf("Could not read snapshot file '%s': %w", file, err)
+	}
+	br := bufio.NewReader(r.in)
+
+	line, err := br.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		r.Close()
+		return nil, fmt.Errorf("Could not read snapshot file '%s': %s", file, err)
+	}
+	if json.Unmarshal(line, &r.Header) == nil && r.Header.Format >= SnapshotFormat {
+		if err = r.validateHeader(); err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.hash = sha256.New()
+		if r.Header.Format == PackedSnapshotFormat {
+			r.chunks = &chunkReader{file: file, refs: json.NewDecoder(br)}
+			r.body = io.TeeReader(r.chunks, r.hash)
+		} else {
+			r.body = io.TeeReader(br, r.hash)
+		}
+		r.dec = json.NewDecoder(r.body)
+		return r, nil
+	}
+
+	r.Header = SnapshotHeader{Format: LegacySnapshotFormat}
+	r.dec = json.NewDecoder(io.MultiReader(bytes.NewReader(line), br))
+	if err = r.seekLegacyContents(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *SnapshotReader) validateHeader() error {
+	if r.Header.Format > PackedSnapshotFormat {
+		return fmt.Errorf("Snapshot file '%s' is of format %d, written by backup-my-bucket %s. This version supports up to format %d.", r.file, r.Header.Format, r.Header.ToolVersion, PackedSnapshotFormat)
+	}
+	if (r.Header.Format == DeltaSnapshotFormat) != (r.Header.Parent != "") {
+		return fmt.Errorf("Snapshot file '%s' is of format %d with parent '%s' in header, only format %d has a parent.", r.file, r.Header.Format, r.Header.Parent, DeltaSnapshotFormat)
+	}
+	if r.Header.Timestamp.IsZero() {
+		return fmt.Errorf("Snapshot file '%s' has no timestamp in header.", r.file)
+	}
+	if r.Header.Bucket == "" {
+		return fmt.Errorf("Snapshot file '%s' has no bucket in header.", r.file)
+	}
+	if r.Header.KeyCount < 0 || r.Header.DeleteMarkerCount < 0 || r.Header.TotalBytes < 0 {
+		return fmt.Errorf("Snapshot file '%s' has negative key count, delete marker count or total bytes in header.", r.file)
+	}
+	if !strings.HasPrefix(r.Header.Digest, "sha256:") {
+		return fmt.Errorf("Snapshot file '%s' has no SHA-256 digest in header.", r.file)
+	}
+	return nil
+}
+
+// Walk the top level object of a legacy snapshot up to the beginning of
+// array Contents, picking up the timestamp on the way.
+func (r *SnapshotReader) seekLegacyContents() error {
+	if t, err := r.dec.Token(); err != nil || t != json.Delim('{') {
+		return fmt.Errorf("Could not parse snapshot file '%s': expected JSON object", r.file)
+	}
+	for r.dec.More() {
+		t, err := r.dec.Token()
+		if err != nil {
+			return fmt.Errorf("Could not parse snapshot file '%s': %s", r.file, err)
+		}
+		switch t {
+		case "Timestamp":
+			err = r.dec.Decode(&r.Header.Timestamp)
+		case "Contents":
+			if t, err = r.dec.Token(); err == nil && t != json.Delim('[') {
+				return fmt.Errorf("Could not parse snapshot file '%s': Contents is not a list", r.file)
+			}
+			if err == nil {
+				return nil
+			}
+		default:
+			var skip json.RawMessage
+			err = r.dec.Decode(&skip)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not parse snapshot file '%s': %s", r.file, err)
+		}
+	}
+	r.dec = nil
+	return nil
+}
+
+// Read next version of snapshot. Return ok false when there are no more
+// versions.
+func (r *SnapshotReader) Next() (version Version, ok bool) {
+	version, ok, err := r.next()
+	if err != nil {
+		log.Fatal("%s", err)
+	}
+	return
+}
+
+func (r *SnapshotReader) next() (version Version, ok bool, err error) {
+	if r.dec != nil && r.dec.More() {
+		if err = r.dec.Decode(&version); err != nil {
+			return version, false, fmt.Errorf("Could not parse snapshot file '%s': %w", r.file, err)
+		}
+		r.count++
+		return version, true, nil
+	}
+	if r.Header.Format < SnapshotFormat {
+		return
+	}
+	if announced := r.Header.KeyCount + r.Header.DeleteMarkerCount; r.count != announced {
+		return version, false, fmt.Errorf("Snapshot file '%s' is truncated: header announces %d versions, found %d.", r.file, announced, r.count)
+	}
+	if _, err = io.Copy(ioutil.Discard, r.body); err != nil {
+		return version, false, fmt.Errorf("Could not read snapshot file '%s': %w", r.file, err)
+	}
+	if digest := "sha256:" + hex.EncodeToString(r.hash.Sum(nil)); digest != r.Header.Digest {
+		return version, false, fmt.Errorf("Snapshot file '%s' is corrupt: header announces digest %s, found %s.", r.file, r.Header.Digest, digest)
+	}
+	return
+}
+
+func (r *SnapshotReader) Close() {
+	if r.chunks != nil {
+		r.chunks.close()
+	}
+	r.in.Close()
+	r.f.Close()
+}
+
+// Call fn for every version of snapshot file without holding the whole
+// snapshot in memory. Versions of a delta snapshot are merged over the
+// versions of its parent, in key order.
+func ForEachVersion(file string, fn func(Version)) {
+	ForEachVersionUntil(file, func(version Version) error {
+		fn(version)
+		return nil
+	})
+}
+
+// Same as ForEachVersion, until fn returns an error, which is returned.
+func ForEachVersionUntil(file string, fn func(Version) error) error {
+	r := OpenSnapshot(file)
+	parent := r.Header.Parent
+	if parent != "" {
+		r.Close()
+		return forEachVersionOfDelta(file, parent, fn)
+	}
+	defer r.Close()
+	for version, ok := r.Next(); ok; version, ok = r.Next() {
+		if err := fn(version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Call fn for every line of snapshot file, as opposed to every version of
+// the snapshot.
+func forEachRecord(file string, fn func(Version)) {
+	r := OpenSnapshot(file)
+	defer r.Close()
+	for version, ok := r.Next(); ok; version, ok = r.Next() {
+		fn(version)
+	}
+}
+
+func forEachVersionOfDelta(file string, parent string, fn func(Version) error) (err error) {
+	parentVersions := SortVersions(Catalog().Fetch(parent), ByKey)
+	defer parentVersions.Close()
+	changes := sortVersions(file, ByKey, forEachRecord)
+	defer changes.Close()
+
+	p, okP := parentVersions.Next()
+	c, okC := changes.Next()
+	for (okP || okC) && err == nil {
+		switch {
+		case !okC || okP && p.Key < c.Key:
+			err = fn(p)
+			p, okP = parentVersions.Next()
+		case !okP || c.Key < p.Key:
+			if !c.Removed {
+				err = fn(c)
+			}
+			c, okC = changes.Next()
+		default:
+			if !c.Removed {
+				err = fn(c)
+			}
+			p, okP = parentVersions.Next()
+			c, okC = changes.Next()
+		}
+	}
+	return
+}
+
+// Read snapshot file from header to end and check it is complete and matches
+// the digest in its header. Legacy snapshot files have no digest, so they are
+// only checked for being well formed. Delta snapshots are only sound when
+// their parents are.
+func VerifySnapshot(file string) error {
+	r, err := openSnapshot(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		_, ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+	}
+
+	parent := r.Header.Parent
+	if parent == "" {
+		return nil
+	}
+	for _, name := range Catalog().List() {
+		if name == parent {
+			if err = VerifySnapshot(Catalog().Fetch(parent)); err != nil {
+				return fmt.Errorf("Parent of snapshot file '%s' is corrupt: %w", file, err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Parent '%s' of snapshot file '%s' is missing from catalog.", parent, file)
+}
+
+// Create snapshot file. Versions are written one at a time by means of
+// Write to a spool file next to the snapshot file, and the snapshot file
+// proper is written on Close, once the header is complete. The file is
+// compressed as configured.
+func CreateSnapshot(file string) (w *SnapshotWriter) {
+	w = &SnapshotWriter{File: file}
+	var openErr error
+	w.spool, openErr = ioutil.TempFile(filepath.Dir(file), TempFilePrefix)
+	if openErr != nil {
+		log.Fatal("Could not create spool file for %s: %s", file, openErr)
+	}
+	w.spoolFile = w.spool.Name()
+	w.buf = bufio.NewWriter(w.spool)
+	if w.sealed, openErr = tempFileWriter(w.buf); openErr != nil {
+		log.Fatal("Could not initialize encryption of spool file %s: %s", w.spoolFile, openErr)
+	}
+	w.hash = sha256.New()
+	w.enc = json.NewEncoder(io.MultiWriter(w.sealed, w.hash))
+	return
+}
+
+func (w *SnapshotWriter) Write(version Version) {
+	if err := w.enc.Encode(version); err != nil {
+		log.Fatal("Could not write spool file %s: %s", w.spoolFile, err)
+	}
+	// Delete markers are counted apart, so the key count is that of the
+	// keys a restore brings back.
+	if version.DeleteMarker {
+		w.deleteMarkerCount++
+		return
+	}
+	w.keyCount++
+	w.totalBytes += version.Size
+}
+
+// Write snapshot file with given header followed by the versions written so
+// far. Format, key count, total bytes and digest of header are filled in
+// here. With DeduplicateSnapshots, the versions of snapshots other than
+// deltas are stored in the pack store and the snapshot file references
+// their chunks.
+func (w *SnapshotWriter) Close(header SnapshotHeader) {
+	if err := w.sealed.Close(); err != nil {
+		log.Fatal("Could not write spool file %s: %s", w.spoolFile, err)
+	}
+	if err := w.buf.Flush(); err != nil {
+		log.Fatal("Could not write spool file %s: %s", w.spoolFile, err)
+	}
+	if _, err := w.spool.Seek(0, 0); err != nil {
+		log.Fatal("Could not rewind spool file %s: %s", w.spoolFile, err)
+	}
+	defer os.Remove(w.spoolFile)
+	defer w.spool.Close()
+
+	header.Format = SnapshotFormat
+	if header.Parent != "" {
+		header.Format = DeltaSnapshotFormat
+	}
+	header.KeyCount = w.keyCount
+	header.DeleteMarkerCount = w.deleteMarkerCount
+	header.TotalBytes = w.totalBytes
+	header.Digest = "sha256:" + hex.EncodeToString(w.hash.Sum(nil))
+	body, err := tempFileReader(w.spool)
+	if err != nil {
+		log.Fatal("Could not read spool file %s: %s", w.spoolFile, err)
+	}
+	if Cfg.BackupSet.DeduplicateSnapshots && header.Parent == "" {
+		header.Format = PackedSnapshotFormat
+		body, header.Digest = packVersions(w.spoolFile)
+	}
+
+	codec, level := ConfiguredCompression()
+	if err := writeSnapshotFile(w.File, header, body, codec, level); err != nil {
+		log.Fatal("%s", err)
+	}
+}
+
+// Write snapshot file from header and lines of versions, compressed by codec
+// at level and encrypted as configured.
+func writeSnapshotFile(file string, header SnapshotHeader, body io.Reader, codec string, level int) error {
+	return WriteFileAtomically(file, func(f io.Writer) error {
+		out, err := snapshotStreamWriter(f, codec, level)
+		if err != nil {
+			return fmt.Errorf("Could not write snapshot file %s: %s", file, err)
+		}
+		buf := bufio.NewWriter(out)
+		if err := json.NewEncoder(buf).Encode(header); err != nil {
+			return fmt.Errorf("Could not write snapshot file %s: %s", file, err)
+		}
+		if _, err := io.Copy(buf, body); err != nil {
+			return fmt.Errorf("Could not write snapshot file %s: %s", file, err)
+		}
+		if err := buf.Flush(); err != nil {
+			return fmt.Errorf("Could not write snapshot file %s: %s", file, err)
+		}
+		if err := out.Close(); err != nil {
+			return fmt.Errorf("Could not write compressed snapshot file %s: %s", file, err)
+		}
+		return nil
+	})
+}
+
+// Write file by means of a temporary file in the same directory that is
+// synced and then renamed into place, so that after a crash the file is
+// either complete or absent. Temporary files are named after
+// TempFilePrefix.
+func WriteFileAtomically(file string, write func(io.Writer) error) error {
+	dir := filepath.Dir(file)
+	tmp, err := ioutil.TempFile(dir, TempFilePrefix)
+	if err != nil {
+		return fmt.Errorf("Could not create temporary file for %s: %s", file, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Could not change mode of temporary file %s: %s", tmp.Name(), err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Could not sync temporary file %s: %s", tmp.Name(), err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("Could not write temporary file %s: %s", tmp.Name(), err)
+	}
+	if err = os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("Could not rename %s to %s: %s", tmp.Name(), file, err)
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("Could not open directory %s: %s", dir, err)
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("Could not sync directory %s: %s", dir, err)
+	}
+	return nil
+}
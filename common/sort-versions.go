@@ -0,0 +1,264 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Order of versions in a sorted stream.
+type VersionLess func(a, b *Version) bool
+
+// Order versions by key, which is the order in which S3 lists keys.
+func ByKey(a, b *Version) bool {
+	return a.Key < b.Key
+}
+
+// Order versions by version id.
+func ByVersionId(a, b *Version) bool {
+	return a.VersionId < b.VersionId
+}
+
+// Stream of the versions of a snapshot file in a given order. Versions are
+// sorted in runs of SortRunSize that are spooled to temporary files in the
+// snapshots directory and then merged, so memory is bounded whatever the
+// size of the snapshot. Every SortMergeWidth runs are merged into a longer
+// run, so few temporary files are open at a time.
+type SortedVersions struct {
+	runs                 runHeap
+}
+
+type sortRun struct {
+	file                 string
+	f                    *os.File
+	dec                  *json.Decoder
+	versions             []Version
+	head                 Version
+}
+
+type versionSorter struct {
+	versions             []Version
+	less                 VersionLess
+}
+
+type runHeap struct {
+	runs                 []*sortRun
+	less                 VersionLess
+}
+
+// Sort versions of snapshot file. Read them in order by means of Next and
+// release temporary files by means of Close.
+func SortVersions(file string, less VersionLess) (s *SortedVersions) {
+	return sortVersions(file, less, ForEachVersion)
+}
+
+// Sort versions of every given snapshot file together.
+func SortSnapshotsVersions(files []string, less VersionLess) (s *SortedVersions) {
+	return sortVersions(strings.Join(files, ", "), less, func(_ string, fn func(Version)) {
+		for _, file := range files {
+			ForEachVersion(file, fn)
+		}
+	})
+}
+
+// Sort versions of every given snapshot of index together.
+func SortIndexedVersions(names []string, less VersionLess) (s *SortedVersions) {
+	return sortVersions(strings.Join(names, ", "), less, func(_ string, fn func(Version)) {
+		for _, name := range names {
+			Index().ForEachVersion(name, "", fn)
+		}
+	})
+}
+
+func sortVersions(file string, less VersionLess, forEach func(string, func(Version))) (s *SortedVersions) {
+	var versions []Version
+	var levels [][]*sortRun
+	addRun := func(run *sortRun) {
+		for level := 0; ; level++ {
+			if level == len(levels) {
+				levels = append(levels, nil)
+			}
+			levels[level] = append(levels[level], run)
+			if len(levels[level]) < SortMergeWidth {
+				return
+			}
+			run = mergeRuns(file, levels[level], less)
+			levels[level] = nil
+		}
+	}
+	forEach(file, func(version Version) {
+		versions = append(versions, version)
+		if len(versions) == SortRunSize {
+			addRun(spillRun(file, versions, less))
+			versions = nil
+		}
+	})
+	if len(versions) > 0 {
+		sort.Sort(versionSorter{versions, less})
+		addRun(&sortRun{versions: versions})
+	}
+
+	var runs []*sortRun
+	for _, level := range levels {
+		runs = append(runs, level...)
+	}
+	return mergingRuns(runs, less)
+}
+
+// Stream of the versions of sorted runs in order.
+func mergingRuns(runs []*sortRun, less VersionLess) (s *SortedVersions) {
+	s = &SortedVersions{runs: runHeap{less: less}}
+	for _, run := range runs {
+		if run.advance() {
+			s.runs.runs = append(s.runs.runs, run)
+		} else {
+			run.close()
+		}
+	}
+	heap.Init(&s.runs)
+	return
+}
+
+// Sort versions and write them to a temporary file, which is then opened for
+// reading.
+func spillRun(file string, versions []Version, less VersionLess) (run *sortRun) {
+	sort.Sort(versionSorter{versions, less})
+	log.Debug("Sorting %d versions of %s.", len(versions), file)
+	return spill(file, mergingRuns([]*sortRun{{versions: versions}}, less))
+}
+
+// Merge sorted runs into a single run in a temporary file.
+func mergeRuns(file string, runs []*sortRun, less VersionLess) (run *sortRun) {
+	log.Debug("Merging %d sorted runs of versions of %s.", len(runs), file)
+	return spill(file, mergingRuns(runs, less))
+}
+
+// Write versions of stream to a temporary file, which is then opened for
+// reading.
+func spill(file string, stream *SortedVersions) (run *sortRun) {
+	f, err := ioutil.TempFile(Cfg.BackupSet.SnapshotsDir, TempFilePrefix)
+	if err != nil {
+		log.Fatal("Could not create temporary file for sorting %s: %s", file, err)
+	}
+	run = &sortRun{file: f.Name(), f: f}
+	buf := bufio.NewWriter(f)
+	sealed, err := tempFileWriter(buf)
+	if err != nil {
+		log.Fatal("Could not initialize encryption of temporary file %s: %s", run.file, err)
+	}
+	enc := json.NewEncoder(sealed)
+	for version, ok := stream.Next(); ok; version, ok = stream.Next() {
+		if err = enc.Encode(version); err != nil {
+			log.Fatal("Could not write temporary file %s: %s", run.file, err)
+		}
+	}
+	if err = sealed.Close(); err != nil {
+		log.Fatal("Could not write temporary file %s: %s", run.file, err)
+	}
+	if err = buf.Flush(); err != nil {
+		log.Fatal("Could not write temporary file %s: %s", run.file, err)
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		log.Fatal("Could not rewind temporary file %s: %s", run.file, err)
+	}
+	in, err := tempFileReader(bufio.NewReader(f))
+	if err != nil {
+		log.Fatal("Could not read temporary file %s: %s", run.file, err)
+	}
+	run.dec = json.NewDecoder(in)
+	return
+}
+
+// Read next version in order. Return ok false when there are no more
+// versions.
+func (s *SortedVersions) Next() (version Version, ok bool) {
+	if len(s.runs.runs) == 0 {
+		return
+	}
+	run := s.runs.runs[0]
+	version = run.head
+	if run.advance() {
+		heap.Fix(&s.runs, 0)
+	} else {
+		run.close()
+		heap.Pop(&s.runs)
+	}
+	return version, true
+}
+
+func (s *SortedVersions) Close() {
+	for _, run := range s.runs.runs {
+		run.close()
+	}
+	s.runs.runs = nil
+}
+
+func (run *sortRun) advance() bool {
+	if run.dec == nil {
+		if len(run.versions) == 0 {
+			return false
+		}
+		run.head = run.versions[0]
+		run.versions = run.versions[1:]
+		return true
+	}
+	if !run.dec.More() {
+		return false
+	}
+	var version Version
+	if err := run.dec.Decode(&version); err != nil {
+		log.Fatal("Could not read temporary file %s: %s", run.file, err)
+	}
+	run.head = version
+	return true
+}
+
+func (run *sortRun) close() {
+	if run.f != nil {
+		run.f.Close()
+		os.Remove(run.file)
+		run.f = nil
+	}
+	run.versions = nil
+}
+
+func (s versionSorter) Len() int           { return len(s.versions) }
+func (s versionSorter) Swap(i, j int)      { s.versions[i], s.versions[j] = s.versions[j], s.versions[i] }
+func (s versionSorter) Less(i, j int) bool { return s.less(&s.versions[i], &s.versions[j]) }
+
+func (h runHeap) Len() int           { return len(h.runs) }
+func (h runHeap) Swap(i, j int)      { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+func (h runHeap) Less(i, j int) bool { return h.less(&h.runs[i].head, &h.runs[j].head) }
+
+func (h *runHeap) Push(x interface{}) {
+	h.runs = append(h.runs, x.(*sortRun))
+}
+
+func (h *runHeap) Pop() interface{} {
+	run := h.runs[len(h.runs) - 1]
+	h.runs = h.runs[:len(h.runs) - 1]
+	return run
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"os"
+	"strconv"
+)
+
+const (
+	Added                = "added"
+	Removed              = "removed"
+	Modified             = "modified"
+)
+
+// A key that differs between two snapshots. Sizes and version ids of the
+// side where the key is absent are left empty.
+type Change struct {
+	Change               string
+	Key                  string
+	OldVersionId         string `json:",omitempty"`
+	NewVersionId         string `json:",omitempty"`
+	OldSize              int64
+	NewSize              int64
+	SizeDelta            int64
+}
+
+type Summary struct {
+	Added                int64
+	Removed              int64
+	Modified             int64
+	Unchanged            int64
+	AddedBytes           int64
+	RemovedBytes         int64
+	ModifiedBytes        int64
+	SizeDelta            int64
+}
+
+type printer interface {
+	change(c Change)
+	summary(s Summary)
+}
+
+// Print keys added, removed and modified from snapshot a to snapshot b in
+// given format, text, json or csv. With summary, print only counts and size
+// deltas. Both snapshots are sorted by key on disk and then merged, so
+// memory is bounded whatever their size.
+func Diff(a string, b string, format string, summary bool) {
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	var p printer
+	switch format {
+	case "text":
+		p = &textPrinter{out: out}
+	case "json":
+		p = &jsonPrinter{enc: json.NewEncoder(out)}
+	case "csv":
+		csvp := &csvPrinter{w: csv.NewWriter(out)}
+		csvp.header(summary)
+		p = csvp
+	default:
+		log.Fatal("Unknown diff format '%s', expected text, json or csv.", format)
+	}
+
+	snapshotA := common.LoadSnapshot(common.FetchSnapshot(a))
+	snapshotB := common.LoadSnapshot(common.FetchSnapshot(b))
+	if snapshotA.Bucket != snapshotB.Bucket {
+		log.Error("WARNING: Comparing snapshots of different buckets, '%s' and '%s'.", snapshotA.Bucket, snapshotB.Bucket)
+	}
+	log.Info("Comparing snapshot '%s' to snapshot '%s'.", snapshotA.File, snapshotB.File)
+
+	s := diffSnapshots(snapshotA.File, snapshotB.File, func(c Change) {
+		if !summary {
+			p.change(c)
+		}
+	})
+	if summary || format == "text" {
+		p.summary(s)
+	}
+	log.Info("Found %d added, %d removed and %d modified keys.", s.Added, s.Removed, s.Modified)
+}
+
+// Merge versions of both snapshot files in key order and call fn for every
+// key that differs. Delete markers count as absent keys.
+func diffSnapshots(fileA string, fileB string, fn func(Change)) (s Summary) {
+	streamA := common.SortVersions(fileA, common.ByKey)
+	defer streamA.Close()
+	streamB := common.SortVersions(fileB, common.ByKey)
+	defer streamB.Close()
+
+	next := func(stream *common.SortedVersions) (common.Version, bool) {
+		for {
+			version, ok := stream.Next()
+			if !ok || !version.DeleteMarker {
+				return version, ok
+			}
+		}
+	}
+
+	va, okA := next(streamA)
+	vb, okB := next(streamB)
+	for okA || okB {
+		var c Change
+		switch {
+		case !okB || okA && va.Key < vb.Key:
+			c = Change{Change: Removed, Key: va.Key, OldVersionId: va.VersionId, OldSize: va.Size}
+			s.Removed++
+			s.RemovedBytes -= va.Size
+			va, okA = next(streamA)
+		case !okA || vb.Key < va.Key:
+			c = Change{Change: Added, Key: vb.Key, NewVersionId: vb.VersionId, NewSize: vb.Size}
+			s.Added++
+			s.AddedBytes += vb.Size
+			vb, okB = next(streamB)
+		default:
+			if va.VersionId == vb.VersionId {
+				s.Unchanged++
+				va, okA = next(streamA)
+				vb, okB = next(streamB)
+				continue
+			}
+			c = Change{Change: Modified, Key: va.Key, OldVersionId: va.VersionId, NewVersionId: vb.VersionId, OldSize: va.Size, NewSize: vb.Size}
+			s.Modified++
+			s.ModifiedBytes += vb.Size - va.Size
+			va, okA = next(streamA)
+			vb, okB = next(streamB)
+		}
+		c.SizeDelta = c.NewSize - c.OldSize
+		s.SizeDelta += c.SizeDelta
+		fn(c)
+	}
+	return
+}
+
+type textPrinter struct {
+	out                  *bufio.Writer
+}
+
+func (p *textPrinter) change(c Change) {
+	switch c.Change {
+	case Added:
+		fmt.Fprintf(p.out, "+ %s %s %d\n", c.Key, c.NewVersionId, c.NewSize)
+	case Removed:
+		fmt.Fprintf(p.out, "- %s %s %d\n", c.Key, c.OldVersionId, c.OldSize)
+	case Modified:
+		fmt.Fprintf(p.out, "M %s %s -> %s %+d\n", c.Key, c.OldVersionId, c.NewVersionId, c.SizeDelta)
+	}
+}
+
+func (p *textPrinter) summary(s Summary) {
+	fmt.Fprintf(p.out, "Added:     %12d keys %+15d bytes\n", s.Added, s.AddedBytes)
+	fmt.Fprintf(p.out, "Removed:   %12d keys %+15d bytes\n", s.Removed, s.RemovedBytes)
+	fmt.Fprintf(p.out, "Modified:  %12d keys %+15d bytes\n", s.Modified, s.ModifiedBytes)
+	fmt.Fprintf(p.out, "Unchanged: %12d keys\n", s.Unchanged)
+	fmt.Fprintf(p.out, "Total:     %12s      %+15d bytes\n", "", s.SizeDelta)
+}
+
+type jsonPrinter struct {
+	enc                  *json.Encoder
+}
+
+func (p *jsonPrinter) change(c Change) {
+	if err := p.enc.Encode(c); err != nil {
+		log.Fatal("Could not write diff: %s", err)
+	}
+}
+
+func (p *jsonPrinter) summary(s Summary) {
+	if err := p.enc.Encode(s); err != nil {
+		log.Fatal("Could not write diff: %s", err)
+	}
+}
+
+type csvPrinter struct {
+	w                    *csv.Writer
+}
+
+func (p *csvPrinter) change(c Change) {
+	p.write(c.Change, c.Key, c.OldVersionId, c.NewVersionId, itoa(c.OldSize), itoa(c.NewSize), itoa(c.SizeDelta))
+}
+
+func (p *csvPrinter) summary(s Summary) {
+	p.write(Added, itoa(s.Added), itoa(s.AddedBytes))
+	p.write(Removed, itoa(s.Removed), itoa(s.RemovedBytes))
+	p.write(Modified, itoa(s.Modified), itoa(s.ModifiedBytes))
+	p.write("unchanged", itoa(s.Unchanged), "0")
+	p.write("total", itoa(s.Added + s.Removed + s.Modified), itoa(s.SizeDelta))
+}
+
+func (p *csvPrinter) header(summary bool) {
+	if summary {
+		p.write("change", "keys", "size_delta")
+	} else {
+		p.write("change", "key", "old_version_id", "new_version_id", "old_size", "new_size", "size_delta")
+	}
+}
+
+func (p *csvPrinter) write(record ...string) {
+	if err := p.w.Write(record); err != nil {
+		log.Fatal("Could not write diff: %s", err)
+	}
+	p.w.Flush()
+}
+
+func itoa(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
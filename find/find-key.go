@@ -0,0 +1,79 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package find
+
+import (
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type byTimestamp []common.Snapshot
+
+// Print the version of key in every snapshot, oldest snapshot first, or
+// "absent" when the snapshot does not hold the key. With prefix, print the
+// version of every key starting with given prefix.
+func FindKey(key string, prefix bool) {
+	log.Info("Looking for key '%s' in every snapshot.", key)
+	matches := func(version common.Version) bool {
+		if prefix {
+			return strings.HasPrefix(version.Key, key)
+		}
+		return version.Key == key
+	}
+
+	snapshots := common.LoadSnapshots()
+	sort.Sort(byTimestamp(snapshots))
+	fmt.Println("Snapshot                         Key / VersionId / Last modified / Size")
+	fmt.Println("-----------------------------------------------------------------------------------------------")
+	for _, snapshot := range snapshots {
+		name := filepath.Base(snapshot.File)
+		if snapshot.Corruption != nil {
+			fmt.Printf("%-33sCORRUPT: %s\n", name, snapshot.Corruption)
+			continue
+		}
+		found := 0
+		report := func(version common.Version) {
+			if !matches(version) {
+				return
+			}
+			found++
+			if version.DeleteMarker {
+				fmt.Printf("%-33s%s deleted by marker %s %s\n", name, version.Key, version.VersionId, version.LastModified.Format("2006-01-02 15:04:05 -0700 MST"))
+			} else {
+				fmt.Printf("%-33s%s %s %s %d\n", name, version.Key, version.VersionId, version.LastModified.Format("2006-01-02 15:04:05 -0700 MST"), version.Size)
+			}
+		}
+		if common.Index() != nil {
+			common.Index().ForEachVersion(name, key, report)
+		} else {
+			common.ForEachVersion(snapshot.File, report)
+		}
+		if found == 0 {
+			fmt.Printf("%-33sabsent\n", name)
+		}
+	}
+}
+
+func (s byTimestamp) Len() int           { return len(s) }
+func (s byTimestamp) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTimestamp) Less(i, j int) bool { return s[i].Timestamp.Before(s[j].Timestamp) }
@@ -20,75 +20,242 @@ package gc
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/SegundamanoMX/backup-my-bucket/common"
 	"github.com/SegundamanoMX/backup-my-bucket/log"
 	"math"
-	"os"
+	"path/filepath"
+	"sort"
 	"time"
 )
 
+type decision struct {
+	Snapshot             common.Snapshot
+	Remove               bool
+	Ignore               bool
+	Blocking             bool
+	Reason               string
+}
+
 func GarbageCollect() {
 	log.Info("Garbage collecting obsolete backups.")
+	common.RemoveStaleTempFiles()
 	snapshots := common.LoadSnapshots()
-	if (len(snapshots) <= common.Cfg.BackupSet.MinimumRedundancy) {
-		log.Fatal("Minimum redundancy is not met. Current snapshot count is %d.", len(snapshots))
+	decisions := discriminateSnapshots(snapshots)
+	printReport(decisions)
+	for _, d := range decisions {
+		if d.Blocking {
+			log.Fatal("Snapshot '%s' is corrupt and within retention, it may be the only one referencing some versions. Refusing to collect until it is repaired or removed from catalog.", d.Snapshot.File)
+		}
+	}
+
+	var oldSnapshots, recentSnapshots []common.Snapshot
+	for _, d := range decisions {
+		switch {
+		case d.Ignore:
+		case d.Remove:
+			oldSnapshots = append(oldSnapshots, d.Snapshot)
+		default:
+			recentSnapshots = append(recentSnapshots, d.Snapshot)
+		}
 	}
-	oldSnapshots, recentSnapshots := discriminateSnapshots(snapshots)
-	discriminateVersions(oldSnapshots, recentSnapshots)
-	versionsToRemove := discriminateVersions(oldSnapshots, recentSnapshots)
-	if ok := removeVersions(versionsToRemove); !ok {
-		log.Fatal("There was an unhandled error removing obsolete versions, exiting.")
+	if len(oldSnapshots) == 0 {
+		log.Info("No snapshot can be removed, nothing to collect.")
+	} else {
+		// Versions are removed in batches as they are discriminated, so
+		// they need not all fit in memory.
+		var versionsToRemove []common.Version
+		flush := func() {
+			if ok := removeVersions(versionsToRemove); !ok {
+				log.Fatal("There was an unhandled error removing obsolete versions, exiting.")
+			}
+			versionsToRemove = nil
+		}
+		discriminateVersions(oldSnapshots, recentSnapshots, func(version common.Version) {
+			versionsToRemove = append(versionsToRemove, version)
+			if len(versionsToRemove) == common.GcQueueSize {
+				flush()
+			}
+		})
+		flush()
+		removeSnapshots(oldSnapshots)
 	}
-	removeSnapshots(oldSnapshots)
+	common.RemoveUnreferencedChunks()
 }
 
-func discriminateSnapshots(snapshots []common.Snapshot) (old []common.Snapshot, recent []common.Snapshot) {
+// Decide for every snapshot whether it is removed. The newest
+// MinimumRedundancy snapshots are always kept, whatever their age, and any
+// other snapshot is removed when it is older than the retention period.
+// Corrupt snapshots neither count towards minimum redundancy nor are
+// removed. Since the versions they reference are unknown, a corrupt
+// snapshot that would be kept blocks collection, and one that would be
+// removed is ignored.
+func discriminateSnapshots(snapshots []common.Snapshot) (decisions []decision) {
 	retentionPeriod := time.Now().AddDate(0, 0, - common.Cfg.BackupSet.RetentionPolicy)
 	log.Info("Retention period is from %s up until now.", retentionPeriod)
-	for _, snapshot := range snapshots {
-		if retentionPeriod.After(snapshot.Timestamp) {
-			log.Info("Snapshot '%s' on %s is old.", snapshot.File, snapshot.Timestamp)
-			old = append(old, snapshot)
-		} else {
-			log.Info("Snapshot '%s' on %s is recent.", snapshot.File, snapshot.Timestamp)
-			recent = append(recent, snapshot)
+	log.Info("Minimum redundancy is %d snapshots, current snapshot count is %d.", common.Cfg.BackupSet.MinimumRedundancy, len(snapshots))
+
+	sorted := make([]common.Snapshot, len(snapshots))
+	copy(sorted, snapshots)
+	for i := range sorted {
+		// Corrupt snapshots may lack a header, but their name tells when
+		// they were taken.
+		if sorted[i].Timestamp.IsZero() {
+			sorted[i].Timestamp, _ = time.Parse(common.SnapshotNameLayout, common.TrimCompressionSuffix(filepath.Base(sorted[i].File)))
+		}
+	}
+	sort.Sort(byNewest(sorted))
+
+	newest := 0
+	for _, snapshot := range sorted {
+		d := decision{Snapshot: snapshot}
+		switch {
+		case snapshot.Corruption != nil && (newest < common.Cfg.BackupSet.MinimumRedundancy || snapshot.Timestamp.IsZero() || !retentionPeriod.After(snapshot.Timestamp)):
+			d.Ignore = true
+			d.Blocking = true
+			d.Reason = "CORRUPT, within retention"
+		case snapshot.Corruption != nil:
+			d.Ignore = true
+			d.Reason = "ignored, snapshot is corrupt"
+		case newest < common.Cfg.BackupSet.MinimumRedundancy:
+			newest++
+			d.Reason = fmt.Sprintf("kept, one of the newest %d snapshots", common.Cfg.BackupSet.MinimumRedundancy)
+		case retentionPeriod.After(snapshot.Timestamp):
+			d.Remove = true
+			d.Reason = fmt.Sprintf("removed, older than %d days", common.Cfg.BackupSet.RetentionPolicy)
+		default:
+			d.Reason = fmt.Sprintf("kept, within the last %d days", common.Cfg.BackupSet.RetentionPolicy)
+		}
+		log.Info("Snapshot '%s' on %s is %s.", snapshot.File, snapshot.Timestamp, d.Reason)
+		decisions = append(decisions, d)
+	}
+
+	// A delta snapshot consists of its parent, so the parents of kept
+	// snapshots are kept too. Parents are older than their children, so one
+	// pass from newest to oldest keeps whole chains.
+	byName := make(map[string]*decision)
+	for i := range decisions {
+		byName[filepath.Base(decisions[i].Snapshot.File)] = &decisions[i]
+	}
+	for _, d := range decisions {
+		if d.Remove || d.Ignore || d.Snapshot.Parent == "" {
+			continue
+		}
+		if parent, ok := byName[d.Snapshot.Parent]; ok && parent.Remove {
+			parent.Remove = false
+			parent.Reason = fmt.Sprintf("kept, parent of snapshot %s", filepath.Base(d.Snapshot.File))
+			log.Info("Snapshot '%s' on %s is %s.", parent.Snapshot.File, parent.Snapshot.Timestamp, parent.Reason)
 		}
 	}
 	return
 }
 
-func discriminateVersions(oldSnapshots []common.Snapshot, recentSnapshots []common.Snapshot) (versionsToRemove []common.Version) {
-	recentId := make(map[string]bool)
+func printReport(decisions []decision) {
+	fmt.Println("Snapshot                         Timestamp                        Decision")
+	fmt.Println("-----------------------------------------------------------------------------------------------")
+	for _, d := range decisions {
+		fmt.Printf("%-33s%-33s%s\n", filepath.Base(d.Snapshot.File), d.Snapshot.Timestamp.Format("2006-01-02 15:04:05 -0700 MST"), d.Reason)
+	}
+}
+
+type byNewest []common.Snapshot
 
-	for _, recentS := range recentSnapshots {
-		log.Debug("Collecting versions for recent snapshot '%s' on %s.", recentS.File, recentS.Timestamp)
-		for _, recentVersion := range recentS.Contents {
-			if common.Cfg.LogLevel >= log.DEBUG {
-				pretty, _ := json.MarshalIndent(recentVersion, "", "    ")
-				log.Debug("Version is recent: %s", pretty)
-			}
-			recentId[recentVersion.VersionId] = true;
+func (s byNewest) Len() int           { return len(s) }
+func (s byNewest) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNewest) Less(i, j int) bool { return s[i].Timestamp.After(s[j].Timestamp) }
+
+// Call remove for every version of old snapshots that no recent snapshot
+// holds, once per version. Versions of recent and old snapshots are sorted
+// by version id into temporary files and merged, so memory is bounded
+// whatever the count and size of snapshots.
+func discriminateVersions(oldSnapshots []common.Snapshot, recentSnapshots []common.Snapshot, remove func(common.Version)) {
+	if common.Index() != nil {
+		discriminateIndexedVersions(oldSnapshots, remove)
+		return
+	}
+	log.Debug("Sorting versions of %d recent snapshots.", len(recentSnapshots))
+	recent := common.SortSnapshotsVersions(snapshotFiles(recentSnapshots), common.ByVersionId)
+	defer recent.Close()
+	log.Debug("Sorting versions of %d old snapshots.", len(oldSnapshots))
+	old := common.SortSnapshotsVersions(snapshotFiles(oldSnapshots), common.ByVersionId)
+	defer old.Close()
+
+	recentVersion, okRecent := recent.Next()
+	removed := ""
+	for oldVersion, ok := old.Next(); ok; oldVersion, ok = old.Next() {
+		for okRecent && recentVersion.VersionId < oldVersion.VersionId {
+			recentVersion, okRecent = recent.Next()
+		}
+		if okRecent && recentVersion.VersionId == oldVersion.VersionId {
+			log.Debug("Version %s of key '%s' is recent.", oldVersion.VersionId, oldVersion.Key)
+			continue
 		}
-	}	
+		if oldVersion.VersionId == removed {
+			continue
+		}
+		removed = oldVersion.VersionId
+		if common.Cfg.LogLevel > log.DEBUG {
+			pretty, _ := json.MarshalIndent(oldVersion, "", "    ")
+			log.Debug("Will remove version: %s", pretty)
+		}
+		remove(oldVersion)
+	}
+}
+
+func snapshotFiles(snapshots []common.Snapshot) (files []string) {
+	for _, snapshot := range snapshots {
+		files = append(files, snapshot.File)
+	}
+	return
+}
 
+// Same as discriminateVersions, by means of the snapshots that the index
+// tells reference every version of old snapshots. Versions of old snapshots
+// are read from the index sorted by version id, and a version is removed
+// unless a snapshot other than the old ones references it.
+func discriminateIndexedVersions(oldSnapshots []common.Snapshot, remove func(common.Version)) {
+	old := make(map[string]bool)
+	var names []string
 	for _, oldS := range oldSnapshots {
-		log.Debug("Discriminating versions for old Snapshot '%s' on %s.", oldS.File, oldS.Timestamp)
-		for _, oldVersion := range oldS.Contents {
-			if _, ok := recentId[oldVersion.VersionId]; ok {
-				continue
-			}
-			recentId[oldVersion.VersionId] = false
-			if common.Cfg.LogLevel > log.DEBUG {
-				pretty, _ := json.MarshalIndent(oldVersion, "", "    ")
-				log.Debug("Will remove version: %s", pretty)
-			}
-			versionsToRemove = append(versionsToRemove, oldVersion)
+		old[filepath.Base(oldS.File)] = true
+		names = append(names, filepath.Base(oldS.File))
+	}
+	log.Debug("Sorting indexed versions of %d old snapshots.", len(oldSnapshots))
+	versions := common.SortIndexedVersions(names, common.ByVersionId)
+	defer versions.Close()
+
+	previous := ""
+	for oldVersion, ok := versions.Next(); ok; oldVersion, ok = versions.Next() {
+		// Keys written before versioning was enabled share version id
+		// null, which is looked up and removed once like any other
+		// version id.
+		if oldVersion.VersionId == previous {
+			continue
+		}
+		previous = oldVersion.VersionId
+		if isReferenced(oldVersion.VersionId, old) {
+			log.Debug("Version %s of key '%s' is recent.", oldVersion.VersionId, oldVersion.Key)
+			continue
+		}
+		if common.Cfg.LogLevel > log.DEBUG {
+			pretty, _ := json.MarshalIndent(oldVersion, "", "    ")
+			log.Debug("Will remove version: %s", pretty)
 		}
+		remove(oldVersion)
 	}
-	return
+}
+
+// Whether a snapshot other than the old ones references version.
+func isReferenced(versionId string, old map[string]bool) bool {
+	for _, name := range common.Index().Referencing(versionId) {
+		if !old[name] {
+			return true
+		}
+	}
+	return false
 }
 
 func removeVersions(versionsToRemove []common.Version) (ok bool) {
@@ -164,8 +331,10 @@ func makeObjectBatches(versions []common.Version) (objectBatches [][]*s3.ObjectI
 
 func removeSnapshots(snapshots []common.Snapshot) {
 	for _, snapshot := range snapshots {
-		if err := os.Remove(snapshot.File); err != nil {
-			log.Error("Error removing snapshot '%s': %s", snapshot.File, err)
+		log.Info("Removing snapshot '%s'.", snapshot.File)
+		common.Catalog().Remove(filepath.Base(snapshot.File))
+		if common.Index() != nil {
+			common.Index().Remove(filepath.Base(snapshot.File))
 		}
 	}
 }
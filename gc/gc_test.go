@@ -0,0 +1,190 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gc
+
+import (
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// The merge of sorted runs removes the same versions as a map of the
+// version ids of recent snapshots, whatever the size of runs and the width
+// of merges.
+func TestDiscriminateVersionsMatchesReference(t *testing.T) {
+	tests := []struct {
+		name                 string
+		runSize              int
+		mergeWidth           int
+		old                  [][]common.Version
+		recent               [][]common.Version
+	}{
+		{
+			name:       "single run",
+			runSize:    1000,
+			mergeWidth: 64,
+			old:        randomSnapshots(1, 3, 50, 80),
+			recent:     randomSnapshots(2, 2, 50, 80),
+		},
+		{
+			name:       "runs spilled",
+			runSize:    7,
+			mergeWidth: 64,
+			old:        randomSnapshots(3, 4, 60, 100),
+			recent:     randomSnapshots(4, 3, 60, 100),
+		},
+		{
+			name:       "runs merged in several levels",
+			runSize:    3,
+			mergeWidth: 2,
+			old:        randomSnapshots(5, 5, 40, 60),
+			recent:     randomSnapshots(6, 2, 40, 60),
+		},
+		{
+			name:       "null only in old snapshots",
+			runSize:    2,
+			mergeWidth: 2,
+			old: [][]common.Version{
+				versions("a", "null", "b", "null", "c", "v1", "d", "null"),
+				versions("a", "null", "e", "null", "c", "v2"),
+			},
+			recent: [][]common.Version{
+				versions("c", "v2", "f", "v3"),
+			},
+		},
+		{
+			name:       "null in old and recent snapshots",
+			runSize:    2,
+			mergeWidth: 2,
+			old: [][]common.Version{
+				versions("a", "null", "b", "null", "c", "v1"),
+				versions("d", "null", "e", "v2"),
+			},
+			recent: [][]common.Version{
+				versions("f", "null", "e", "v2"),
+			},
+		},
+		{
+			name:       "no recent snapshots",
+			runSize:    3,
+			mergeWidth: 2,
+			old:        randomSnapshots(7, 3, 30, 40),
+		},
+	}
+
+	defer func(runSize, mergeWidth int, fatal func(string, ...interface{})) {
+		common.SortRunSize, common.SortMergeWidth = runSize, mergeWidth
+		log.Fatal = fatal
+	}(common.SortRunSize, common.SortMergeWidth, log.Fatal)
+	log.Fatal = t.Fatalf
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "gc-test")
+		if err != nil {
+			t.Fatalf("Could not create temporary directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		common.Cfg.BackupSet.SnapshotsDir = dir
+		common.SortRunSize, common.SortMergeWidth = test.runSize, test.mergeWidth
+
+		old := writeSnapshots(t, dir, "old", test.old)
+		recent := writeSnapshots(t, dir, "recent", test.recent)
+		var removed []string
+		discriminateVersions(old, recent, func(version common.Version) {
+			removed = append(removed, version.VersionId)
+		})
+
+		expected := referenceRemoved(test.old, test.recent)
+		sort.Strings(removed)
+		if !reflect.DeepEqual(removed, expected) {
+			t.Errorf("%s: removed %v, expected %v.", test.name, removed, expected)
+		}
+		if leftovers, _ := filepath.Glob(filepath.Join(dir, common.TempFilePrefix+"*")); len(leftovers) > 0 {
+			t.Errorf("%s: temporary files left behind: %v", test.name, leftovers)
+		}
+	}
+}
+
+// Version ids held by old snapshots and by no recent one, once each and in
+// order.
+func referenceRemoved(old, recent [][]common.Version) (removed []string) {
+	kept := make(map[string]bool)
+	for _, snapshot := range recent {
+		for _, version := range snapshot {
+			kept[version.VersionId] = true
+		}
+	}
+	for _, snapshot := range old {
+		for _, version := range snapshot {
+			if !kept[version.VersionId] {
+				kept[version.VersionId] = true
+				removed = append(removed, version.VersionId)
+			}
+		}
+	}
+	sort.Strings(removed)
+	return
+}
+
+// Versions of alternating keys and version ids.
+func versions(keysAndIds ...string) (versions []common.Version) {
+	for i := 0; i < len(keysAndIds); i += 2 {
+		versions = append(versions, common.Version{Key: keysAndIds[i], VersionId: keysAndIds[i+1]})
+	}
+	return
+}
+
+// Snapshots of every key, each at one of ids version ids drawn at random
+// from seed, so that snapshots share some versions. One key in ten is at
+// version null.
+func randomSnapshots(seed int64, count, keys, ids int) (snapshots [][]common.Version) {
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < count; i++ {
+		var snapshot []common.Version
+		for k := 0; k < keys; k++ {
+			versionId := fmt.Sprintf("v%04d", r.Intn(ids))
+			if k%10 == 0 {
+				versionId = "null"
+			}
+			snapshot = append(snapshot, common.Version{Key: fmt.Sprintf("key%04d", k), VersionId: versionId})
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return
+}
+
+func writeSnapshots(t *testing.T, dir, prefix string, snapshots [][]common.Version) (written []common.Snapshot) {
+	for i, versions := range snapshots {
+		file := filepath.Join(dir, fmt.Sprintf("%s%d", prefix, i))
+		w := common.CreateSnapshot(file)
+		for _, version := range versions {
+			w.Write(version)
+		}
+		w.Close(common.SnapshotHeader{Bucket: "images-slave", Timestamp: time.Now()})
+		written = append(written, common.Snapshot{File: file})
+	}
+	return
+}
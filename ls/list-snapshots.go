@@ -23,19 +23,49 @@ import (
 	"fmt"
 	"github.com/SegundamanoMX/backup-my-bucket/common"
 	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"strings"
 )
 
-func ListSnapshots() {
+// List snapshots of backup set, or only those carrying label when given
+// one. Labels and note of a snapshot follow its totals.
+func ListSnapshots(label string) {
 	log.Info("Listing snapshots for backup set.")
 	snapshots := common.LoadSnapshots()
 	fmt.Println("Snapshot                         Timestamp                        Key count          Total size")
 	fmt.Println("-----------------------------------------------------------------------------------------------")
 	for _, snapshot := range snapshots {
-		var size int64 = 0
-		for _, version := range snapshot.Contents {
-			size =+ version.Size
+		if label != "" && !snapshot.HasLabel(label) {
+			continue
 		}
-		fmt.Printf ("%-33s%-33s%-15d%12dKb\n", filepath.Base(snapshot.File), snapshot.Timestamp.Format("2006-01-02 15:04:05 -0700 MST"), len(snapshot.Contents), size)
+		if snapshot.Corruption != nil {
+			fmt.Printf ("%-33sCORRUPT: %s\n", filepath.Base(snapshot.File), snapshot.Corruption)
+			continue
+		}
+		size := snapshot.TotalBytes
+		count := snapshot.KeyCount
+		if common.Index() != nil {
+			count, size = common.Index().Totals(filepath.Base(snapshot.File))
+		} else if snapshot.Format == common.LegacySnapshotFormat || snapshot.Parent != "" {
+			// Header does not count versions, or counts only those of the delta.
+			size, count = 0, 0
+			common.ForEachVersion(snapshot.File, func(version common.Version) {
+				if version.DeleteMarker {
+					return
+				}
+				size += version.Size
+				count++
+			})
+		}
+		fmt.Printf ("%-33s%-33s%-15d%12dKb%s\n", filepath.Base(snapshot.File), snapshot.Timestamp.Format("2006-01-02 15:04:05 -0700 MST"), count, size, describe(snapshot.SnapshotHeader))
 	}
 }
 
+func describe(header common.SnapshotHeader) (description string) {
+	if len(header.Labels) > 0 {
+		description += "  " + strings.Join(header.Labels, ",")
+	}
+	if header.Note != "" {
+		description += "  \"" + header.Note + "\""
+	}
+	return
+}
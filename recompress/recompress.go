@@ -0,0 +1,64 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recompress
+
+import (
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"os"
+)
+
+// Rewrite given snapshots, or every snapshot when given "all", compressed by
+// codec at level, and store them in catalog again. Snapshots keep their
+// names. Snapshots compressed by codec already are skipped unless forced.
+// Exit with an error when any snapshot could not be recompressed.
+func Recompress(names []string, codec string, level int, force bool) {
+	if err := common.CheckCompression(codec, level); err != nil {
+		log.Fatal("%s", err)
+	}
+	if len(names) == 1 && names[0] == "all" {
+		names = common.Catalog().List()
+	} else {
+		for i, name := range names {
+			names[i] = common.ResolveSnapshot(name)
+		}
+	}
+
+	failed := 0
+	for _, name := range names {
+		file := common.Catalog().Fetch(name)
+		log.Info("Recompressing snapshot '%s' with %s.", name, codec)
+		from, err := common.RecompressSnapshot(file, codec, level, force)
+		switch {
+		case err != nil:
+			fmt.Printf("%-33sFAILED: %s\n", name, err)
+			failed++
+		case from == codec && !force:
+			fmt.Printf("%-33sskipped, already %s\n", name, codec)
+		default:
+			common.Catalog().Store(file)
+			fmt.Printf("%-33s%s -> %s\n", name, from, codec)
+		}
+	}
+	if failed > 0 {
+		log.Error("%d of %d snapshots could not be recompressed.", failed, len(names))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rekey
+
+import (
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Rewrite given snapshots, or every snapshot when given "all", encrypted as
+// configured under fresh keys, along with the chunks they reference, and
+// store them in catalog again. Files encrypted under retired keys are read
+// with the identities of oldIdentityFile or the passphrase in
+// oldPassphraseFile. Exit with an error when any file could not be rekeyed.
+func Rekey(names []string, oldIdentityFile string, oldPassphraseFile string) {
+	if err := common.CheckSnapshotKeys(); err != nil {
+		log.Fatal("%s", err)
+	}
+	if oldIdentityFile != "" {
+		if err := common.AddSnapshotIdentities(oldIdentityFile); err != nil {
+			log.Fatal("%s", err)
+		}
+	}
+	if oldPassphraseFile != "" {
+		data, err := ioutil.ReadFile(oldPassphraseFile)
+		if err != nil {
+			log.Fatal("Could not read passphrase file %s: %s", oldPassphraseFile, err)
+		}
+		common.AddSnapshotPassphrase(strings.TrimRight(string(data), "\r\n"))
+	}
+
+	all := len(names) == 1 && names[0] == "all"
+	if all {
+		names = common.Catalog().List()
+	} else {
+		for i, name := range names {
+			names[i] = common.ResolveSnapshot(name)
+		}
+	}
+	to := common.ConfiguredEncryption()
+
+	// Chunks are rekeyed before the snapshots referencing them, so a
+	// snapshot is never stored rekeyed while its chunks are not.
+	chunks := make(map[string]bool)
+	if all {
+		for id := range common.Catalog().ListChunks() {
+			chunks[id] = true
+		}
+	} else {
+		for _, name := range names {
+			ids, err := common.SnapshotChunks(common.Catalog().Fetch(name))
+			if err != nil {
+				log.Fatal("Could not read chunks of snapshot '%s': %s", name, err)
+			}
+			for _, id := range ids {
+				chunks[id] = true
+			}
+		}
+	}
+	var ids []string
+	for id := range chunks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	failed := 0
+	for _, id := range ids {
+		log.Debug("Rekeying chunk %s.", id)
+		if from, err := common.RekeyChunk(id); err != nil {
+			log.Error("Could not rekey chunk %s: %s", id, err)
+			failed++
+		} else {
+			log.Debug("Chunk %s: %s -> %s.", id, from, to)
+		}
+	}
+	if len(ids) > 0 {
+		log.Info("Rekeyed %d of %d chunks.", len(ids) - failed, len(ids))
+	}
+
+	for _, name := range names {
+		file := common.Catalog().Fetch(name)
+		log.Info("Rekeying snapshot '%s' with %s.", name, to)
+		from, err := common.RekeySnapshot(file)
+		switch {
+		case err != nil:
+			fmt.Printf("%-33sFAILED: %s\n", name, err)
+			failed++
+		case from == common.SnapshotEncryptionNone && to == common.SnapshotEncryptionNone:
+			fmt.Printf("%-33sskipped, not encrypted\n", name)
+		default:
+			common.Catalog().Store(file)
+			fmt.Printf("%-33s%s -> %s\n", name, from, to)
+		}
+	}
+	if failed > 0 {
+		log.Error("%d files could not be rekeyed.", failed)
+		os.Exit(1)
+	}
+}
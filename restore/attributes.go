@@ -0,0 +1,182 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package restore
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Attributes of an object that restore carries from slave to master along
+// with its contents.
+type Attributes struct {
+	CacheControl         *string
+	ContentDisposition   *string
+	ContentEncoding      *string
+	ContentLanguage      *string
+	ContentType          *string
+	WebsiteRedirectLocation *string
+	Expires              *time.Time
+	Metadata             map[string]*string
+	Tags                 []*s3.Tag
+	Acl                  *s3.AccessControlPolicy
+}
+
+// Fields that configuration may override. Configuration may also override
+// user metadata by means of field Metadata.<name>.
+var overridableFields = []string{"CacheControl", "ContentDisposition", "ContentEncoding", "ContentLanguage", "ContentType", "WebsiteRedirectLocation"}
+
+// Fields that configuration may strip besides the overridable ones.
+var strippableFields = []string{"Expires", "Metadata", "Tags", "ACL"}
+
+func (a *Attributes) header(field string) **string {
+	switch field {
+	case "CacheControl": return &a.CacheControl
+	case "ContentDisposition": return &a.ContentDisposition
+	case "ContentEncoding": return &a.ContentEncoding
+	case "ContentLanguage": return &a.ContentLanguage
+	case "ContentType": return &a.ContentType
+	case "WebsiteRedirectLocation": return &a.WebsiteRedirectLocation
+	}
+	return nil
+}
+
+// Check that configuration overrides and strips known fields only.
+func checkRestoreConfig() {
+	known := func(field string, fields []string) bool {
+		if strings.HasPrefix(field, "Metadata.") && len(field) > len("Metadata.") {
+			return true
+		}
+		for _, f := range fields {
+			if f == field { return true }
+		}
+		return false
+	}
+	for field := range common.Cfg.BackupSet.Restore.Override {
+		if !known(field, overridableFields) {
+			log.Fatal("Cannot override field '%s' on restore. Overridable fields are %s and Metadata.<name>.", field, overridableFields)
+		}
+	}
+	for _, field := range common.Cfg.BackupSet.Restore.Strip {
+		if !known(field, overridableFields) && !known(field, strippableFields) {
+			log.Fatal("Cannot strip field '%s' on restore. Strippable fields are %s, %s and Metadata.<name>.", field, overridableFields, strippableFields)
+		}
+	}
+}
+
+func stripped(field string) bool {
+	for _, f := range common.Cfg.BackupSet.Restore.Strip {
+		if f == field { return true }
+	}
+	return false
+}
+
+func attributesOf(resp *s3.GetObjectOutput) (a Attributes) {
+	a.CacheControl = resp.CacheControl
+	a.ContentDisposition = resp.ContentDisposition
+	a.ContentEncoding = resp.ContentEncoding
+	a.ContentLanguage = resp.ContentLanguage
+	a.ContentType = resp.ContentType
+	a.WebsiteRedirectLocation = resp.WebsiteRedirectLocation
+	if resp.Expires != nil {
+		if expires, err := http.ParseTime(*resp.Expires); err == nil {
+			a.Expires = &expires
+		} else {
+			log.Debug("Ignoring unparseable Expires '%s': %s", *resp.Expires, err)
+		}
+	}
+	a.Metadata = make(map[string]*string)
+	for name, value := range resp.Metadata {
+		a.Metadata[strings.ToLower(name)] = value
+	}
+	return
+}
+
+// Fetch tags and ACL of version, unless configuration strips them. The ACL
+// is fetched only when configuration copies ACLs.
+func fetchTagsAndAcl(s3Client *s3.S3, version common.Version, a *Attributes) error {
+	if !stripped("Tags") {
+		resp, err := s3Client.GetObjectTagging(&s3.GetObjectTaggingInput{
+			Bucket:          aws.String(common.Cfg.BackupSet.SlaveBucket),
+			Key:             aws.String(version.Key),
+			VersionId:       aws.String(version.VersionId),
+		})
+		if err != nil {
+			return err
+		}
+		a.Tags = resp.TagSet
+	}
+	if common.Cfg.BackupSet.Restore.CopyAcl && !stripped("ACL") {
+		resp, err := s3Client.GetObjectAcl(&s3.GetObjectAclInput{
+			Bucket:          aws.String(common.Cfg.BackupSet.SlaveBucket),
+			Key:             aws.String(version.Key),
+			VersionId:       aws.String(version.VersionId),
+		})
+		if err != nil {
+			return err
+		}
+		a.Acl = &s3.AccessControlPolicy{Grants: resp.Grants, Owner: resp.Owner}
+	}
+	return nil
+}
+
+// Strip and then override attributes as configured.
+func applyRestoreConfig(a *Attributes) {
+	for _, field := range common.Cfg.BackupSet.Restore.Strip {
+		switch {
+		case field == "Expires":
+			a.Expires = nil
+		case field == "Metadata":
+			a.Metadata = make(map[string]*string)
+		case field == "Tags":
+			a.Tags = nil
+		case field == "ACL":
+			a.Acl = nil
+		case strings.HasPrefix(field, "Metadata."):
+			delete(a.Metadata, strings.ToLower(strings.TrimPrefix(field, "Metadata.")))
+		default:
+			*a.header(field) = nil
+		}
+	}
+	for field, value := range common.Cfg.BackupSet.Restore.Override {
+		if strings.HasPrefix(field, "Metadata.") {
+			a.Metadata[strings.ToLower(strings.TrimPrefix(field, "Metadata."))] = aws.String(value)
+		} else {
+			*a.header(field) = aws.String(value)
+		}
+	}
+}
+
+// Encode tags as the query string PutObject expects.
+func tagging(tags []*s3.Tag) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for _, tag := range tags {
+		values.Set(aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+	}
+	return aws.String(values.Encode())
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package restore
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"io"
+)
+
+// Stops reading a snapshot once the key looked up is found.
+var errFound = errors.New("found")
+
+// Restore a single key of master to its version in given snapshot, or to
+// given version id when snapshot is empty.
+func RestoreKey(snapshotName string, key string, versionId string, force bool) {
+	version := lookupVersion(snapshotName, key, versionId, force)
+	restoreVersions("version " + version.VersionId + " of key " + key, func(restore func(common.Version)) {
+		restore(version)
+	})
+}
+
+// Download to local file the version of key in given snapshot, or given
+// version id when snapshot is empty.
+func Get(snapshotName string, key string, versionId string, output string, force bool) {
+	version := lookupVersion(snapshotName, key, versionId, force)
+	log.Info("Downloading version %s of key '%s' to '%s'.", version.VersionId, version.Key, output)
+
+	common.ConfigureAws(common.Cfg.BackupSet.SlaveRegion)
+	s3Client := s3.New(nil)
+	slaveKey := common.SlaveCustomerKey()
+	customerKey := version.Encryption == common.EncryptionSSEC
+
+	for retry := 1; ; retry++ {
+		getParams := &s3.GetObjectInput{
+			Bucket:          aws.String(common.Cfg.BackupSet.SlaveBucket),
+			Key:             aws.String(version.Key),
+			VersionId:       aws.String(version.VersionId),
+		}
+		if customerKey && slaveKey != nil {
+			getParams.SSECustomerAlgorithm = slaveKey.Algorithm
+			getParams.SSECustomerKey = slaveKey.Key
+			getParams.SSECustomerKeyMD5 = slaveKey.KeyMD5
+		}
+		err := common.WriteFileAtomically(output, func(f io.Writer) error {
+			getResp, err := s3Client.GetObject(getParams)
+			if err != nil {
+				return err
+			}
+			defer getResp.Body.Close()
+			_, err = io.Copy(f, getResp.Body)
+			return err
+		})
+		if err == nil {
+			break
+		}
+		if retry == common.MaxRetries {
+			log.Fatal("Error downloading version %s of key '%s', retry %d: %s", version.VersionId, version.Key, retry, err)
+		}
+		log.Error("Error downloading version %s of key '%s', retry %d: %s", version.VersionId, version.Key, retry, err)
+		if slaveKey != nil && version.Encryption == "" {
+			// Encryption of version is unknown, it may be SSE-C.
+			customerKey = !customerKey
+		}
+	}
+	log.Info("Downloaded version %s of key '%s' to '%s'.", version.VersionId, version.Key, output)
+}
+
+// Look up version of key in snapshot, or make up the version of given id
+// without looking at any snapshot.
+func lookupVersion(snapshotName string, key string, versionId string, force bool) (version common.Version) {
+	if versionId != "" {
+		return common.Version{Key: key, VersionId: versionId}
+	}
+
+	var snapshot common.Snapshot
+	found := false
+	if common.Index() != nil {
+		name := common.ResolveSnapshot(snapshotName)
+		snapshot, found = common.Index().Snapshot(name)
+		if !found {
+			log.Fatal("Snapshot '%s' is not in index.", name)
+		}
+		if snapshot.Corruption != nil {
+			log.Fatal("Snapshot file '%s' is CORRUPT: %s", snapshot.File, snapshot.Corruption)
+		}
+		checkBucket(snapshot, force)
+		version, found = common.Index().Lookup(name, key)
+	} else {
+		snapshot = common.LoadSnapshot(common.FetchSnapshot(snapshotName))
+		checkBucket(snapshot, force)
+		common.ForEachVersionUntil(snapshot.File, func(v common.Version) error {
+			if v.Key == key {
+				version = v
+				found = true
+				return errFound
+			}
+			return nil
+		})
+	}
+	if !found {
+		log.Fatal("Key '%s' is absent from snapshot '%s'.", key, snapshot.File)
+	}
+	if version.DeleteMarker {
+		log.Fatal("Key '%s' is deleted in snapshot '%s'.", key, snapshot.File)
+	}
+	log.Info("Snapshot '%s' holds version %s of key '%s'.", snapshot.File, version.VersionId, key)
+	return
+}
@@ -25,12 +25,18 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/SegundamanoMX/backup-my-bucket/common"
 	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"github.com/SegundamanoMX/backup-my-bucket/snapshot"
+	"github.com/SegundamanoMX/backup-my-bucket/verify"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 type DownloadWork struct {
 	Wid                  int
 	Version              common.Version
+	CustomerKey          bool
 	Retry                int
 }
 
@@ -38,6 +44,7 @@ type UploadWork struct {
 	Wid                  int
 	Version              common.Version
 	Bytes                []byte
+	Attributes           Attributes
 	Retry                int
 }
 
@@ -47,9 +54,57 @@ var (
 	uploadWorkQueue                    = make(chan UploadWork, common.RestoreWorkerCount)
 )
 
-func Restore(snapshotName string) {
-	snapshot := common.LoadSnapshot(common.Cfg.BackupSet.SnapshotsDir + snapshotName)
+func Restore(snapshotName string, force bool, verifyAfter bool) {
+	snapshot := common.LoadSnapshot(common.FetchSnapshot(snapshotName))
+	checkBucket(snapshot, force)
+	restoreSnapshot(snapshot, snapshotName)
+	if verifyAfter {
+		verifyRestore(snapshot, snapshotName)
+	}
+}
+
+// Restore master bucket to the state of slave bucket at given time. For
+// every key, the version current at that time is restored, unless the key
+// was deleted at that time.
+func RestoreAt(at time.Time, verifyAfter bool) {
+	oldest := time.Now()
+	for _, s := range common.LoadSnapshots() {
+		if s.Corruption == nil && s.Timestamp.Before(oldest) {
+			oldest = s.Timestamp
+		}
+	}
+	if at.Before(oldest) {
+		log.Error("WARNING: %s is before the oldest retained snapshot on %s. Command gc may have removed versions needed for restoring.", at, oldest)
+	}
+
+	file := filepath.Join(common.Cfg.BackupSet.SnapshotsDir, common.TempFilePrefix + "restore-" + at.Format(common.SnapshotNameLayout))
+	defer os.Remove(file)
+	snapshot.WriteSnapshotAt(at, file)
+	restored := common.LoadSnapshot(file)
+	restoreSnapshot(restored, at.String())
+	if verifyAfter {
+		verifyRestore(restored, at.String())
+	}
+}
 
+// Exit with an error when master does not match restored snapshot.
+func verifyRestore(snapshot common.Snapshot, snapshotName string) {
+	if !verify.VerifyBucket(snapshot.File, verify.Master, false) {
+		log.Fatal("Bucket %s does not match snapshot %s after restore.", common.Cfg.BackupSet.MasterBucket, snapshotName)
+	}
+	log.Info("Verified bucket %s against snapshot %s.", common.Cfg.BackupSet.MasterBucket, snapshotName)
+}
+
+func restoreSnapshot(snapshot common.Snapshot, snapshotName string) {
+	restoreVersions(snapshotName, func(restore func(common.Version)) {
+		common.ForEachVersion(snapshot.File, restore)
+	})
+}
+
+// Restore to master the versions that forEach gives, by means of a pool of
+// download and upload workers.
+func restoreVersions(snapshotName string, forEach func(func(common.Version))) {
+	checkRestoreConfig()
 	log.Info("Restoring bucket %s to snapshot %s.", common.Cfg.BackupSet.MasterBucket, snapshotName)
 
 	common.ConfigureAws(common.Cfg.BackupSet.MasterRegion)
@@ -60,10 +115,14 @@ func Restore(snapshotName string) {
 		go uploadWorker()
 	}
 
-	for _, version := range snapshot.Contents {
+	forEach(func(version common.Version) {
+		if version.DeleteMarker {
+			log.Debug("Skip key '%s', deleted in snapshot.", version.Key)
+			return
+		}
 		wid := <-readyRestoreWorkers
-		downloadWorkQueue <- DownloadWork{Wid: wid, Version: version, Retry: 0}
-	}
+		downloadWorkQueue <- DownloadWork{Wid: wid, Version: version, CustomerKey: version.Encryption == common.EncryptionSSEC, Retry: 0}
+	})
 
 	for i := common.RestoreWorkerCount; i > 0; i-- {
 		log.Info("Wait for %d restore workers to finish.", i)
@@ -76,9 +135,26 @@ func Restore(snapshotName string) {
 	log.Info("Restored bucket %s to snapshot %s.", common.Cfg.BackupSet.MasterBucket, snapshotName)
 }
 
+// Refuse to restore a snapshot that was taken of a bucket other than the
+// slave bucket, unless forced.
+func checkBucket(snapshot common.Snapshot, force bool) {
+	if snapshot.Bucket == "" {
+		log.Info("Snapshot '%s' does not record its bucket, assuming it is of slave bucket %s.", snapshot.File, common.Cfg.BackupSet.SlaveBucket)
+		return
+	}
+	if snapshot.Bucket == common.Cfg.BackupSet.SlaveBucket {
+		return
+	}
+	if !force {
+		log.Fatal("Snapshot '%s' is of bucket %s, not of slave bucket %s. Use -force to restore it anyway.", snapshot.File, snapshot.Bucket, common.Cfg.BackupSet.SlaveBucket)
+	}
+	log.Error("Snapshot '%s' is of bucket %s, not of slave bucket %s. Restoring anyway as forced.", snapshot.File, snapshot.Bucket, common.Cfg.BackupSet.SlaveBucket)
+}
+
 func downloadWorker() {
 
 	s3Client := s3.New(nil)
+	slaveKey := common.SlaveCustomerKey()
 
 	for work := range downloadWorkQueue {
 
@@ -98,11 +174,13 @@ func downloadWorker() {
 			// ResponseContentLanguage:    aws.String("ResponseContentLanguage"),
 			// ResponseContentType:        aws.String("ResponseContentType"),
 			// ResponseExpires:            aws.Time(time.Now()),
-			// SSECustomerAlgorithm:       aws.String("SSECustomerAlgorithm"),
-			// SSECustomerKey:             aws.String("SSECustomerKey"),
-			// SSECustomerKeyMD5:          aws.String("SSECustomerKeyMD5"),
 			VersionId:                  aws.String(work.Version.VersionId),
 		}
+		if work.CustomerKey && slaveKey != nil {
+			getParams.SSECustomerAlgorithm = slaveKey.Algorithm
+			getParams.SSECustomerKey = slaveKey.Key
+			getParams.SSECustomerKeyMD5 = slaveKey.KeyMD5
+		}
 		getResp, getErr := s3Client.GetObject(getParams)
 		if getErr != nil {
 			if awsErr, ok := getErr.(awserr.Error); ok {
@@ -120,6 +198,10 @@ func downloadWorker() {
 			if work.Retry == common.MaxRetries {
 				log.Fatal("[%d] Error downloading version, retry %d: %s", work.Wid, work.Retry, work.Version)
 			}
+			if slaveKey != nil && work.Version.Encryption == "" {
+				// Encryption of version is unknown, it may be SSE-C.
+				work.CustomerKey = !work.CustomerKey
+			}
 			log.Error("[%d] Error downloading version, retry %d: %s", work.Wid, work.Retry, work.Version)
 			downloadWorkQueue <- work
 			continue
@@ -138,14 +220,28 @@ func downloadWorker() {
 			continue
 		}
 
+		attributes := attributesOf(getResp)
+		if attrErr := fetchTagsAndAcl(s3Client, work.Version, &attributes); attrErr != nil {
+			work.Retry++
+			if work.Retry == common.MaxRetries {
+				log.Fatal("[%d] Could not fetch tags and ACL of version %s, retry %d: %s", work.Wid, work.Version, work.Retry, attrErr)
+			}
+			log.Error("[%d] Could not fetch tags and ACL of version %s, retry %d: %s", work.Wid, work.Version, work.Retry, attrErr)
+			downloadWorkQueue <- work
+			continue
+		}
+		applyRestoreConfig(&attributes)
+
 		log.Debug("[%d] Downloaded version: %s", work.Wid, work.Version)
-		uploadWorkQueue <- UploadWork{Wid: work.Wid, Version: work.Version, Bytes: bytes, Retry: 0}
+		uploadWorkQueue <- UploadWork{Wid: work.Wid, Version: work.Version, Bytes: bytes, Attributes: attributes, Retry: 0}
 	}
 }
 
 func uploadWorker() {
 
 	s3Client := s3.New(nil)
+	masterKey := common.MasterCustomerKey()
+	sse, kmsKeyId := common.MasterServerSideEncryption()
 
 	for work := range uploadWorkQueue {
 
@@ -155,31 +251,43 @@ func uploadWorker() {
 			Key:                aws.String(work.Version.Key),  // Required
 			// ACL:                aws.String("ObjectCannedACL"),
 			Body:               bytes.NewReader(work.Bytes),
-			// CacheControl:       aws.String("CacheControl"),
-			// ContentDisposition: aws.String("ContentDisposition"),
-			// ContentEncoding:    aws.String("ContentEncoding"),
-			// ContentLanguage:    aws.String("ContentLanguage"),
+			CacheControl:       work.Attributes.CacheControl,
+			ContentDisposition: work.Attributes.ContentDisposition,
+			ContentEncoding:    work.Attributes.ContentEncoding,
+			ContentLanguage:    work.Attributes.ContentLanguage,
 			// ContentLength:      aws.Long(1),
-			// ContentType:        aws.String("ContentType"),
-			// Expires:            aws.Time(time.Now()),
+			ContentType:        work.Attributes.ContentType,
+			Expires:            work.Attributes.Expires,
 			// GrantFullControl:   aws.String("GrantFullControl"),
 			// GrantRead:          aws.String("GrantRead"),
 			// GrantReadACP:       aws.String("GrantReadACP"),
 			// GrantWriteACP:      aws.String("GrantWriteACP"),
-			// Metadata: map[string]*string{
-			// 	"Key": aws.String("MetadataValue"), // Required
-			//	// More values...
-			// },
+			Metadata:           work.Attributes.Metadata,
 			// RequestPayer:            aws.String("RequestPayer"),
-			// SSECustomerAlgorithm:    aws.String("SSECustomerAlgorithm"),
-			// SSECustomerKey:          aws.String("SSECustomerKey"),
-			// SSECustomerKeyMD5:       aws.String("SSECustomerKeyMD5"),
-			// SSEKMSKeyID:             aws.String("SSEKMSKeyId"),
-			// ServerSideEncryption:    aws.String("ServerSideEncryption"),
+			SSEKMSKeyID:             kmsKeyId,
+			ServerSideEncryption:    sse,
 			// StorageClass:            aws.String("StorageClass"),
-			// WebsiteRedirectLocation: aws.String("WebsiteRedirectLocation"),
+			Tagging:                 tagging(work.Attributes.Tags),
+			WebsiteRedirectLocation: work.Attributes.WebsiteRedirectLocation,
+		}
+		if masterKey != nil {
+			putParams.SSECustomerAlgorithm = masterKey.Algorithm
+			putParams.SSECustomerKey = masterKey.Key
+			putParams.SSECustomerKeyMD5 = masterKey.KeyMD5
 		}
 		_, putErr := s3Client.PutObject(putParams)
+		if putErr == nil && work.Attributes.Acl != nil {
+			_, putErr = s3Client.PutObjectAcl(&s3.PutObjectAclInput{
+				Bucket:              aws.String(common.Cfg.BackupSet.MasterBucket),
+				Key:                 aws.String(work.Version.Key),
+				AccessControlPolicy: work.Attributes.Acl,
+			})
+			// Buckets whose ACLs are disabled take objects but not ACLs.
+			if awsErr, ok := putErr.(awserr.Error); ok && awsErr.Code() == "AccessControlListNotSupported" {
+				log.Error("[%d] WARNING: master does not support ACLs, restored version without its ACL: %s", work.Wid, work.Version)
+				putErr = nil
+			}
+		}
 
 		if putErr != nil {
 			if awsErr, ok := putErr.(awserr.Error); ok {
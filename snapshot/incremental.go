@@ -0,0 +1,205 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3 event notification, as delivered to SQS queues, SNS topics and Lambda
+// functions.
+type eventNotification struct {
+	Records              []eventRecord
+}
+
+type eventRecord struct {
+	EventName            string `json:"eventName"`
+	S3                   struct {
+		Bucket               struct {
+			Name                 string `json:"name"`
+		} `json:"bucket"`
+		Object               struct {
+			Key                  string `json:"key"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// Take a delta snapshot over given parent snapshot. The keys named by the
+// event notifications in file changes are the only keys listed in slave,
+// and the snapshot file records only their versions.
+func SnapshotIncremental(changes string, parentSelector string) {
+	started := time.Now()
+	parentName := common.ResolveSnapshot(parentSelector)
+	parent := common.LoadSnapshot(common.Catalog().Fetch(parentName))
+	if parent.Bucket != "" && parent.Bucket != common.Cfg.BackupSet.SlaveBucket {
+		log.Fatal("Snapshot '%s' is of bucket %s, not of slave bucket %s.", parentName, parent.Bucket, common.Cfg.BackupSet.SlaveBucket)
+	}
+	keys := readChangeFeed(changes)
+	log.Info("Taking incremental snapshot %s of bucket %s over snapshot %s, %d keys changed.", started.Format(common.SnapshotNameLayout), common.Cfg.BackupSet.SlaveBucket, parentName, len(keys))
+
+	common.ConfigureAws(common.Cfg.BackupSet.SlaveRegion)
+	file := snapshotFile(started)
+	w := common.CreateSnapshot(file)
+
+	keyQueue := make(chan string, common.SnapshotWorkerCount)
+	changed := make(chan common.Version, common.SnapshotWorkerCount)
+	var workers sync.WaitGroup
+	for wid := 0; wid < common.SnapshotWorkerCount; wid++ {
+		workers.Add(1)
+		go func(wid int) {
+			defer workers.Done()
+			s3Client := s3.New(nil)
+			for key := range keyQueue {
+				version := listKey(wid, s3Client, key)
+				if !version.Removed {
+					version = describeVersions(wid, s3Client, []common.Version{version})[0]
+				}
+				changed <- version
+			}
+		}(wid)
+	}
+	go func() {
+		for _, key := range keys {
+			keyQueue <- key
+		}
+		close(keyQueue)
+		workers.Wait()
+		close(changed)
+	}()
+
+	for version := range changed {
+		w.Write(version)
+	}
+	header := common.SnapshotHeader{Timestamp: started, Parent: parentName}
+	completeHeader(&header, started)
+	w.Close(header)
+	common.StoreSnapshot(file)
+
+	log.Info("Incremental snapshot %s of bucket %s is DONE.", started.Format(common.SnapshotNameLayout), common.Cfg.BackupSet.SlaveBucket)
+}
+
+// Read keys of slave named by the event notifications in file, sorted and
+// without duplicates. File holds one notification after another, and is
+// decompressed when its name ends in .gz.
+func readChangeFeed(file string) (keys []string) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal("Could not open change feed %s: %s", file, err)
+	}
+	defer f.Close()
+	var in io.Reader = f
+	if filepath.Ext(file) == ".gz" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			log.Fatal("Could not initialize gzip decompressor for %s: %s", file, err)
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	changed := make(map[string]bool)
+	dec := json.NewDecoder(in)
+	for {
+		var notification eventNotification
+		if err := dec.Decode(&notification); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatal("Could not parse change feed %s: %s", file, err)
+		}
+		for _, record := range notification.Records {
+			if !strings.HasPrefix(record.EventName, "ObjectCreated:") && !strings.HasPrefix(record.EventName, "ObjectRemoved:") && !strings.HasPrefix(record.EventName, "LifecycleExpiration:") {
+				log.Debug("Skip event %s.", record.EventName)
+				continue
+			}
+			if record.S3.Bucket.Name != common.Cfg.BackupSet.SlaveBucket {
+				log.Debug("Skip event %s of bucket %s.", record.EventName, record.S3.Bucket.Name)
+				continue
+			}
+			// Keys in event notifications are URL encoded.
+			key, err := url.QueryUnescape(record.S3.Object.Key)
+			if err != nil {
+				log.Fatal("Could not decode key '%s' in change feed %s: %s", record.S3.Object.Key, file, err)
+			}
+			if common.IsCatalogKey(key) {
+				continue
+			}
+			changed[key] = true
+		}
+	}
+
+	for key := range changed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// List the versions of key and pick the current one. Key is recorded as
+// removed when it has no versions left.
+func listKey(wid int, s3Client *s3.S3, key string) common.Version {
+	params := &s3.ListObjectVersionsInput{
+		Bucket:          aws.String(common.Cfg.BackupSet.SlaveBucket),
+		MaxKeys:         aws.Int64(common.SnapshotBatchSize),
+		Prefix:          aws.String(key),
+	}
+	var entries []entry
+	for retry := 1; ; {
+		resp, err := s3Client.ListObjectVersions(params)
+		if err != nil {
+			if retry == common.MaxRetries {
+				log.Fatal("[%d] Error listing versions of key '%s', retry %d: %s", wid, key, retry, err)
+			}
+			log.Error("[%d] Error listing versions of key '%s', retry %d: %s", wid, key, retry, err)
+			retry++
+			continue
+		}
+		for _, e := range listEntries(wid, resp) {
+			if e.Version.Key == key {
+				entries = append(entries, e)
+			}
+		}
+		// Key sorts before every other key it prefixes, so its versions
+		// are over once the listing moves on to another key.
+		if !aws.BoolValue(resp.IsTruncated) || aws.StringValue(resp.NextKeyMarker) != key {
+			break
+		}
+		params.KeyMarker = resp.NextKeyMarker
+		params.VersionIdMarker = resp.NextVersionIdMarker
+	}
+
+	if version, ok := pickLatest(entries); ok {
+		log.Debug("[%d] Discover version: %+v", wid, version)
+		return version
+	}
+	log.Debug("[%d] Key '%s' has no versions left.", wid, key)
+	return common.Version{Key: key, Removed: true}
+}
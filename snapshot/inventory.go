@@ -0,0 +1,243 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Manifest of an S3 Inventory report. Data files are listed by their keys
+// in destination bucket.
+type inventoryManifest struct {
+	SourceBucket         string `json:"sourceBucket"`
+	DestinationBucket    string `json:"destinationBucket"`
+	CreationTimestamp    string `json:"creationTimestamp"`
+	FileFormat           string `json:"fileFormat"`
+	FileSchema           string `json:"fileSchema"`
+	Files                []inventoryFile `json:"files"`
+}
+
+type inventoryFile struct {
+	Key                  string `json:"key"`
+	Size                 int64 `json:"size"`
+	MD5checksum          string `json:"MD5checksum"`
+}
+
+// Fields of inventory data files that snapshots need.
+var requiredInventoryFields = []string{"Key", "VersionId"}
+
+// Encryption statuses of inventory as recorded in snapshots.
+var inventoryEncryption = map[string]string{
+	"SSE-S3":             common.EncryptionAES256,
+	"SSE-KMS":            common.EncryptionKMS,
+	"SSE-C":              common.EncryptionSSEC,
+	"NOT-SSE":            "",
+}
+
+// Take snapshot of the current versions of slave listed by the S3 Inventory
+// report of given manifest, without listing slave. Manifest is either a
+// local file, whose data files are in the same directory, or
+// s3://BUCKET/KEY, whose data files are in the destination bucket of the
+// manifest. Only CSV reports of every version of slave are supported.
+func SnapshotFromInventory(manifestLocation string) {
+	started := time.Now()
+	common.ConfigureAws(common.Cfg.BackupSet.SlaveRegion)
+	s3Client := s3.New(nil)
+	manifest, columns, timestamp := readInventoryManifest(s3Client, manifestLocation)
+
+	log.Info("Taking snapshot %s of bucket %s from inventory %s.", timestamp.Format(common.SnapshotNameLayout), common.Cfg.BackupSet.SlaveBucket, manifestLocation)
+	file := snapshotFile(timestamp)
+	w := common.CreateSnapshot(file)
+	for _, dataFile := range manifest.Files {
+		location := inventoryDataLocation(manifestLocation, manifest.DestinationBucket, dataFile.Key)
+		readInventoryData(s3Client, location, dataFile, columns, func(version common.Version) {
+			w.Write(version)
+		})
+	}
+	header := common.SnapshotHeader{Timestamp: timestamp, Inventory: manifestLocation}
+	completeHeader(&header, started)
+	w.Close(header)
+	common.StoreSnapshot(file)
+
+	log.Info("Snapshot %s of bucket %s is DONE.", timestamp.Format(common.SnapshotNameLayout), common.Cfg.BackupSet.SlaveBucket)
+}
+
+// Read manifest of inventory and check it is a CSV report of slave. Return
+// the manifest, the columns of its data files by field and the time the
+// report was created.
+func readInventoryManifest(s3Client *s3.S3, manifestLocation string) (manifest inventoryManifest, columns map[string]int, timestamp time.Time) {
+	body := openInventoryObject(s3Client, manifestLocation)
+	err := json.NewDecoder(body).Decode(&manifest)
+	body.Close()
+	if err != nil {
+		log.Fatal("Could not parse inventory manifest %s: %s", manifestLocation, err)
+	}
+	if manifest.SourceBucket != common.Cfg.BackupSet.SlaveBucket {
+		log.Fatal("Inventory manifest %s is of bucket %s, not of slave bucket %s.", manifestLocation, manifest.SourceBucket, common.Cfg.BackupSet.SlaveBucket)
+	}
+	if manifest.FileFormat != "CSV" {
+		log.Fatal("Inventory manifest %s is of format %s, only CSV is supported.", manifestLocation, manifest.FileFormat)
+	}
+	millis, err := strconv.ParseInt(manifest.CreationTimestamp, 10, 64)
+	if err != nil {
+		log.Fatal("Could not parse creation timestamp '%s' of inventory manifest %s: %s", manifest.CreationTimestamp, manifestLocation, err)
+	}
+	timestamp = time.Unix(0, millis * int64(time.Millisecond))
+	columns = make(map[string]int)
+	for i, field := range strings.Split(manifest.FileSchema, ",") {
+		columns[strings.TrimSpace(field)] = i
+	}
+	for _, field := range requiredInventoryFields {
+		if _, ok := columns[field]; !ok {
+			log.Fatal("Inventory manifest %s has no field %s. Configure inventory of slave to include all versions.", manifestLocation, field)
+		}
+	}
+	return
+}
+
+// Location of data file of inventory. Data files of a local manifest are
+// looked up by name in the directory of the manifest.
+func inventoryDataLocation(manifestLocation string, destinationBucket string, key string) string {
+	if !strings.HasPrefix(manifestLocation, "s3://") {
+		return filepath.Join(filepath.Dir(manifestLocation), path.Base(key))
+	}
+	bucket := destinationBucket[strings.LastIndex(destinationBucket, ":") + 1:]
+	return "s3://" + bucket + "/" + key
+}
+
+// Open local file, or object given as s3://BUCKET/KEY.
+func openInventoryObject(s3Client *s3.S3, location string) io.ReadCloser {
+	if !strings.HasPrefix(location, "s3://") {
+		f, err := os.Open(location)
+		if err != nil {
+			log.Fatal("Could not open inventory file %s: %s", location, err)
+		}
+		return f
+	}
+	bucketAndKey := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+	if len(bucketAndKey) != 2 || bucketAndKey[0] == "" || bucketAndKey[1] == "" {
+		log.Fatal("Could not parse inventory location %s, expected s3://BUCKET/KEY.", location)
+	}
+	resp, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket:          aws.String(bucketAndKey[0]),
+		Key:             aws.String(bucketAndKey[1]),
+	})
+	if err != nil {
+		log.Fatal("Could not fetch inventory file %s: %s", location, err)
+	}
+	return resp.Body
+}
+
+// Read data file of inventory and call fn for the current version of every
+// key. The data file is checked against the MD5 checksum of the manifest.
+func readInventoryData(s3Client *s3.S3, location string, dataFile inventoryFile, columns map[string]int, fn func(common.Version)) {
+	log.Info("Reading inventory data file %s.", location)
+	body := openInventoryObject(s3Client, location)
+	defer body.Close()
+	checksum := md5.New()
+	in := io.TeeReader(body, checksum)
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		log.Fatal("Could not initialize gzip decompressor for %s: %s", location, err)
+	}
+	defer gz.Close()
+
+	r := csv.NewReader(gz)
+	r.FieldsPerRecord = len(columns)
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal("Could not parse inventory data file %s: %s", location, err)
+		}
+		if isLatest := field(record, "IsLatest"); isLatest != "" && isLatest != "true" {
+			continue
+		}
+		version, err := inventoryVersion(record, field)
+		if err != nil {
+			log.Fatal("Could not parse line %d of inventory data file %s: %s", line, location, err)
+		}
+		if common.IsCatalogKey(version.Key) {
+			continue
+		}
+		fn(version)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, in); err != nil {
+		log.Fatal("Could not read inventory data file %s: %s", location, err)
+	}
+	if sum := hex.EncodeToString(checksum.Sum(nil)); dataFile.MD5checksum != "" && sum != dataFile.MD5checksum {
+		log.Fatal("Inventory data file %s is corrupt: manifest announces MD5 %s, found %s.", location, dataFile.MD5checksum, sum)
+	}
+}
+
+func inventoryVersion(record []string, field func([]string, string) string) (version common.Version, err error) {
+	// Keys in inventory reports are URL encoded.
+	if version.Key, err = url.QueryUnescape(field(record, "Key")); err != nil {
+		return
+	}
+	version.VersionId = field(record, "VersionId")
+	version.DeleteMarker = field(record, "IsDeleteMarker") == "true"
+	if size := field(record, "Size"); size != "" {
+		if version.Size, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return
+		}
+	}
+	if lastModified := field(record, "LastModifiedDate"); lastModified != "" {
+		if version.LastModified, err = time.Parse(time.RFC3339, lastModified); err != nil {
+			return
+		}
+	}
+	version.ETag = field(record, "ETag")
+	version.StorageClass = field(record, "StorageClass")
+	if status := field(record, "EncryptionStatus"); status != "" {
+		encryption, ok := inventoryEncryption[status]
+		if !ok {
+			return version, fmt.Errorf("unknown encryption status '%s'", status)
+		}
+		version.Encryption = encryption
+	}
+	return
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import (
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The report in sample-inventory holds a current and a noncurrent version
+// of ads/1.jpg, a delete marker over a version of ads/2.jpg and a URL
+// encoded key.
+func TestReadSampleInventory(t *testing.T) {
+	common.Cfg.BackupSet.SlaveBucket = "images-slave"
+	manifestLocation := "../sample-inventory/manifest.json"
+
+	manifest, columns, timestamp := readInventoryManifest(nil, manifestLocation)
+	if want := time.Date(2015, 6, 5, 0, 0, 0, 0, time.UTC); !timestamp.Equal(want) {
+		t.Errorf("Timestamp is %s, expected %s.", timestamp, want)
+	}
+	var versions []common.Version
+	for _, dataFile := range manifest.Files {
+		location := inventoryDataLocation(manifestLocation, manifest.DestinationBucket, dataFile.Key)
+		readInventoryData(nil, location, dataFile, columns, func(version common.Version) {
+			versions = append(versions, version)
+		})
+	}
+
+	expected := []common.Version{
+		{
+			Key:          "ads/1.jpg",
+			VersionId:    "3HL4kqtJlcpXroDTDmJ.rmSpXd3dIbrHY",
+			Size:         1024,
+			LastModified: time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC),
+			ETag:         "d41d8cd98f00b204e9800998ecf8427e",
+			StorageClass: "STANDARD",
+			Encryption:   common.EncryptionAES256,
+		},
+		{
+			Key:          "ads/2.jpg",
+			VersionId:    "x5ExqJ8bsVDH0o.9YCtG6XAQ8Vd4mXkO",
+			DeleteMarker: true,
+			LastModified: time.Date(2015, 6, 2, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			Key:          "ads/my photoñ.jpg",
+			VersionId:    "Bn3a_B7kxXw5pVuJrO2dWp7Dgq2rS1tL",
+			Size:         4096,
+			LastModified: time.Date(2015, 6, 3, 9, 15, 0, 0, time.UTC),
+			ETag:         "92eb5ffee6ae2fec3ad71c777531578f-2",
+			StorageClass: "STANDARD_IA",
+			Encryption:   common.EncryptionSSEC,
+		},
+	}
+	if len(versions) != len(expected) {
+		t.Fatalf("Read %d versions, expected %d: %+v", len(versions), len(expected), versions)
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(versions[i], expected[i]) {
+			t.Errorf("Version %d is %+v, expected %+v.", i, versions[i], expected[i])
+		}
+	}
+}
+
+func TestInventoryVersionRejectsUnknownEncryption(t *testing.T) {
+	columns := map[string]int{"Key": 0, "VersionId": 1, "EncryptionStatus": 2}
+	field := func(record []string, name string) string {
+		return record[columns[name]]
+	}
+	if _, err := inventoryVersion([]string{"a", "v", "SSE-XYZ"}, field); err == nil {
+		t.Error("Unknown encryption status was accepted.")
+	}
+}
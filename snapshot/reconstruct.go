@@ -0,0 +1,59 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import (
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"time"
+)
+
+// Reconstruct the snapshot the slave bucket would have had at given time out
+// of the history of versions and delete markers of the slave bucket. The
+// result is a regular snapshot file named after the given time.
+func Reconstruct(at time.Time) {
+	started := time.Now()
+	if at.After(started) {
+		log.Fatal("Cannot reconstruct snapshot at %s, which is in the future.", at)
+	}
+	timestampStr := at.Format(common.SnapshotNameLayout)
+	for _, name := range common.Catalog().List() {
+		if common.TrimCompressionSuffix(name) == timestampStr {
+			log.Fatal("Snapshot %s already exists.", name)
+		}
+	}
+
+	log.Info("Reconstructing snapshot %s of bucket %s.", timestampStr, common.Cfg.BackupSet.SlaveBucket)
+	pick = pickAt(at)
+	takeSnapshot(started, common.SnapshotHeader{Timestamp: at, Reconstructed: true})
+}
+
+// Pick the version of key that was current at given time, which is a
+// delete marker if key was deleted at that time. Keys created after that
+// time are left out.
+func pickAt(at time.Time) picker {
+	return func(entries []entry) (version common.Version, ok bool) {
+		for _, e := range entries {
+			if !e.Version.LastModified.After(at) {
+				return e.Version, true
+			}
+		}
+		return
+	}
+}
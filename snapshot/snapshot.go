@@ -19,16 +19,15 @@ along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
 package snapshot
 
 import (
-	"compress/gzip"
-	"encoding/json"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/SegundamanoMX/backup-my-bucket/common"
 	"github.com/SegundamanoMX/backup-my-bucket/log"
-	"io/ioutil"
-	"time"
 	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
 var (
@@ -37,56 +36,112 @@ var (
 	workRequests                      = make(chan string)
 	snapshotWorkQueue                 = make([]string, 0)
 	versionsFunnel                    = make(chan []common.Version, common.SnapshotWorkerCount)
-	versions                          = make([]common.Version, 0)
 )
 
-func Snapshot() {
+// An entry is a version or a delete marker of a key, as listed by
+// ListObjectVersions.
+type entry struct {
+	Version              common.Version
+	IsLatest             bool
+}
+
+// A picker chooses the version of a key that goes into the snapshot out of
+// the entries of the key, listed newest first. It returns ok false when no
+// version of the key goes into the snapshot.
+type picker func(entries []entry) (version common.Version, ok bool)
+
+var (
+	pick                              picker = pickLatest
+	labels                            []string
+	note                              string
+)
+
+// Label subsequent snapshots with given labels and note.
+func Label(snapshotLabels []string, snapshotNote string) {
+	for _, label := range snapshotLabels {
+		if err := common.CheckLabel(label); err != nil {
+			log.Fatal("%s", err)
+		}
+	}
+	labels, note = snapshotLabels, snapshotNote
+}
 
+func Snapshot() {
 	timestamp := time.Now()
-	timestampStr := timestamp.Format("20060102150405-0700MST")
-	log.Info("Taking snapshot %s of bucket %s.", timestampStr, common.Cfg.BackupSet.SlaveBucket)
-	
+	log.Info("Taking snapshot %s of bucket %s.", timestamp.Format(common.SnapshotNameLayout), common.Cfg.BackupSet.SlaveBucket)
+	pick = pickLatest
+	takeSnapshot(timestamp, common.SnapshotHeader{Timestamp: timestamp})
+}
+
+// Explore slave bucket and dump the versions chosen by pick to a snapshot
+// file named after the timestamp of header, then store it in catalog.
+func takeSnapshot(started time.Time, header common.SnapshotHeader) {
+	file := snapshotFile(header.Timestamp)
+	dumpSnapshot(file, started, header)
+	common.StoreSnapshot(file)
+
+	log.Info("Snapshot %s of bucket %s is DONE.", header.Timestamp.Format(common.SnapshotNameLayout), common.Cfg.BackupSet.SlaveBucket)
+}
+
+// Path to snapshot file named after given timestamp.
+func snapshotFile(timestamp time.Time) string {
+	codec, _ := common.ConfiguredCompression()
+	return common.Cfg.BackupSet.SnapshotsDir + "/" + timestamp.Format(common.SnapshotNameLayout) + common.CompressionSuffix(codec)
+}
+
+// Write to given file the snapshot the slave bucket had at given time. The
+// file is not stored in catalog.
+func WriteSnapshotAt(at time.Time, file string) {
+	pick = pickAt(at)
+	dumpSnapshot(file, time.Now(), common.SnapshotHeader{Timestamp: at, Reconstructed: true})
+}
+
+func dumpSnapshot(file string, started time.Time, header common.SnapshotHeader) {
 	common.ConfigureAws(common.Cfg.BackupSet.SlaveRegion)
 	for wid := 0; wid < common.SnapshotWorkerCount; wid++ {
 		readySnapshotWorkers <- wid
 	}
 
+	log.Info("Dumping snapshot to %s.", file)
+	w := common.CreateSnapshot(file)
+
 	go func (){ workRequests <- "" }()
 	go dispatchWorkers()
 
 	for newVersions := range versionsFunnel {
-		versions = append(versions, newVersions...)
+		for _, version := range newVersions {
+			w.Write(version)
+		}
 	}
+	completeHeader(&header, started)
+	w.Close(header)
+}
 
-	log.Info("Dumping snapshot to %s%s.", common.Cfg.BackupSet.SnapshotsDir, timestampStr)
-	snapshot := &common.Snapshot{
-		File: common.Cfg.BackupSet.SnapshotsDir + "/" + timestampStr,
-		Timestamp: timestamp,
-		Contents: versions,
-	}
-	if common.Cfg.BackupSet.CompressSnapshots { snapshot.File += ".Z" }
-	bytes, err := json.MarshalIndent(snapshot, "", "    ")
+// Fill in the origin and labels of snapshot in header.
+func completeHeader(header *common.SnapshotHeader, started time.Time) {
+	hostname, err := os.Hostname()
 	if err != nil {
-		log.Fatal("Could not marshal snapshot %s: %s", timestampStr, err)
+		log.Error("Could not query hostname: %s", err)
 	}
-	if common.Cfg.BackupSet.CompressSnapshots {
-		f, openErr := os.OpenFile(snapshot.File, os.O_WRONLY|os.O_CREATE, 0644)
-		if openErr != nil {
-			log.Fatal("Could not open file %s: %s", snapshot.File, openErr)
-		}
-		defer f.Close()
+	header.BackupSet = common.Cfg.BackupSet.Name
+	header.Bucket = common.Cfg.BackupSet.SlaveBucket
+	header.Region = common.Cfg.BackupSet.SlaveRegion
+	header.ToolVersion = common.AppVersion
+	header.Hostname = hostname
+	header.Duration = time.Since(started)
+	header.Labels = labels
+	header.Note = note
+}
 
-		w := gzip.NewWriter(f)
-		if _, writeErr := w.Write(bytes); writeErr != nil {
-			log.Fatal("Could not write compressed snapshot file %s: %s", snapshot.File, writeErr)
-		}
-		w.Close()
-	} else {
-		if writeErr := ioutil.WriteFile(snapshot.File, bytes, 0644); err != nil {
-			log.Fatal("Could not write snapshot file %s: %s", snapshot.File, writeErr)
+// Pick the current version of key, which is a delete marker if key is
+// deleted.
+func pickLatest(entries []entry) (version common.Version, ok bool) {
+	for _, e := range entries {
+		if e.IsLatest {
+			return e.Version, true
 		}
 	}
-	log.Info("Snapshot %s of bucket %s is DONE.", timestampStr, common.Cfg.BackupSet.SlaveBucket)
+	return
 }
 
 func dispatchWorkers() {
@@ -134,8 +189,7 @@ func snapshotWorker(wid int, path string) {
 		Prefix:          aws.String(path),
 		// VersionIdMarker: aws.String("VersionIdMarker"),
 	}
-	var discoveredVersions []common.Version
-	buffer := make([]common.Version, common.SnapshotBatchSize)
+	var pending []entry
 
 	for batch := 1; ; batch++{
 		log.Debug("[%d] Request batch %d for path '%s'", wid, batch, path)
@@ -159,32 +213,29 @@ func snapshotWorker(wid int, path string) {
 
 		for _, cp := range resp.CommonPrefixes {
 			discoveredPath := *cp.Prefix
+			if common.IsCatalogKey(discoveredPath) {
+				log.Info("[%d] Skip path '%s' of catalog.", wid, discoveredPath)
+				continue
+			}
 			log.Info("[%d] Discover path '%s'.", wid, discoveredPath)
 			workRequests <- discoveredPath
 		}
 
-		index := 0
-		for _, v := range resp.Versions {
-			if v.IsLatest == nil { log.Fatal("[%d] IsLatest is nil", wid) }
-			if v.IsLatest != nil && *v.IsLatest == true {
-				if v.Key == nil { log.Fatal("[%d] Key is nil", wid) }
-				if v.LastModified == nil { log.Fatal("[%d] LastModified is nil", wid) }
-				if v.Size == nil { log.Fatal("[%d] Size is nil", wid) }
-				if v.VersionId == nil { log.Fatal("[%d] VersionId is nil", wid) }
-				version := common.Version{
-					Key: *v.Key,
-					LastModified: *v.LastModified,
-					Size: *v.Size,
-					VersionId: *v.VersionId,
-				}
-				log.Debug("[%d] Discover latest version: %s", wid, version)
-				buffer[index] = version
-				index++
-			} else {
-				log.Debug("[%d] Discover noncurrent latest version for key '%s'.", wid, *v.Key)
+		// Entries of the last key of a truncated batch may continue in the
+		// next batch, so they wait until the key is complete.
+		entries := append(pending, listEntries(wid, resp)...)
+		complete := len(entries)
+		if *resp.IsTruncated {
+			for complete > 0 && entries[complete - 1].Version.Key == entries[len(entries) - 1].Version.Key {
+				complete--
 			}
 		}
-		discoveredVersions = append(discoveredVersions, buffer[0:index]...)
+		// Versions are registered batch by batch, so a path holding
+		// millions of keys is never held in memory whole.
+		if complete > 0 {
+			versionsFunnel <- describeVersions(wid, s3Client, pickVersions(wid, entries[:complete]))
+		}
+		pending = append([]entry(nil), entries[complete:]...)
 
 		if ! *resp.IsTruncated { break }
 		log.Info("[%d] Continue exploring path '%s'.", wid, path)
@@ -203,9 +254,193 @@ func snapshotWorker(wid int, path string) {
 		params.KeyMarker = resp.NextKeyMarker
 	}
 
-	log.Info("[%d] Registering versions for path '%s'.", wid, path)
-	versionsFunnel <- discoveredVersions
+	if len(pending) > 0 {
+		versionsFunnel <- describeVersions(wid, s3Client, pickVersions(wid, pending))
+	}
 
 	log.Info("[%d] Done exploring path '%s'.", wid, path)
 	doneSnapshotWorkers <- wid
 }
+
+// Merge versions and delete markers of batch, sorted by key and then newest
+// first.
+func listEntries(wid int, resp *s3.ListObjectVersionsOutput) (entries []entry) {
+	for _, v := range resp.Versions {
+		if v.IsLatest == nil { log.Fatal("[%d] IsLatest is nil", wid) }
+		if v.Key == nil { log.Fatal("[%d] Key is nil", wid) }
+		if v.LastModified == nil { log.Fatal("[%d] LastModified is nil", wid) }
+		if v.Size == nil { log.Fatal("[%d] Size is nil", wid) }
+		if v.VersionId == nil { log.Fatal("[%d] VersionId is nil", wid) }
+		if common.IsCatalogKey(*v.Key) {
+			log.Debug("[%d] Skip key '%s' of catalog.", wid, *v.Key)
+			continue
+		}
+		entries = append(entries, entry{
+			Version: common.Version{
+				Key: *v.Key,
+				LastModified: *v.LastModified,
+				Size: *v.Size,
+				VersionId: *v.VersionId,
+				ETag: strings.Trim(aws.StringValue(v.ETag), "\""),
+				StorageClass: aws.StringValue(v.StorageClass),
+				Owner: owner(v.Owner),
+			},
+			IsLatest: *v.IsLatest,
+		})
+	}
+	for _, m := range resp.DeleteMarkers {
+		if m.IsLatest == nil { log.Fatal("[%d] IsLatest is nil", wid) }
+		if m.Key == nil { log.Fatal("[%d] Key is nil", wid) }
+		if m.LastModified == nil { log.Fatal("[%d] LastModified is nil", wid) }
+		if m.VersionId == nil { log.Fatal("[%d] VersionId is nil", wid) }
+		if common.IsCatalogKey(*m.Key) {
+			continue
+		}
+		entries = append(entries, entry{
+			Version: common.Version{
+				Key: *m.Key,
+				LastModified: *m.LastModified,
+				VersionId: *m.VersionId,
+				DeleteMarker: true,
+				Owner: owner(m.Owner),
+			},
+			IsLatest: *m.IsLatest,
+		})
+	}
+	sort.Stable(byKeyNewestFirst(entries))
+	return
+}
+
+func owner(o *s3.Owner) *common.Owner {
+	if o == nil || o.ID == nil {
+		return nil
+	}
+	return &common.Owner{ID: *o.ID, DisplayName: aws.StringValue(o.DisplayName)}
+}
+
+// Group entries by key and pick a version for each key.
+func pickVersions(wid int, entries []entry) (versions []common.Version) {
+	for start, end := 0, 0; start < len(entries); start = end {
+		for end = start + 1; end < len(entries) && entries[end].Version.Key == entries[start].Version.Key; end++ {
+		}
+		if version, ok := pick(entries[start:end]); ok {
+			log.Debug("[%d] Discover version: %+v", wid, version)
+			versions = append(versions, version)
+		}
+	}
+	return
+}
+
+type byKeyNewestFirst []entry
+
+func (e byKeyNewestFirst) Len() int      { return len(e) }
+func (e byKeyNewestFirst) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e byKeyNewestFirst) Less(i, j int) bool {
+	if e[i].Version.Key != e[j].Version.Key {
+		return e[i].Version.Key < e[j].Version.Key
+	}
+	if !e[i].Version.LastModified.Equal(e[j].Version.LastModified) {
+		return e[i].Version.LastModified.After(e[j].Version.LastModified)
+	}
+	return e[i].IsLatest && !e[j].IsLatest
+}
+
+// Record headers, encryption, user metadata and tags of versions as
+// configured. Delete markers have none.
+func describeVersions(wid int, s3Client *s3.S3, versions []common.Version) []common.Version {
+	metadata := common.Cfg.BackupSet.SnapshotObjectMetadata
+	if !metadata && !common.EncryptionConfigured() && !common.Cfg.BackupSet.SnapshotObjectTags {
+		return versions
+	}
+	for i := range versions {
+		if versions[i].DeleteMarker {
+			continue
+		}
+		if metadata || common.EncryptionConfigured() {
+			headVersion(wid, s3Client, &versions[i], metadata)
+		}
+		if common.Cfg.BackupSet.SnapshotObjectTags {
+			tagVersion(wid, s3Client, &versions[i])
+		}
+	}
+	return versions
+}
+
+// Record encryption of version, and its content headers and user metadata
+// when metadata is set.
+func headVersion(wid int, s3Client *s3.S3, version *common.Version, metadata bool) {
+	params := &s3.HeadObjectInput{
+		Bucket:          aws.String(common.Cfg.BackupSet.SlaveBucket),
+		Key:             aws.String(version.Key),
+		VersionId:       aws.String(version.VersionId),
+	}
+	key := common.SlaveCustomerKey()
+	for retry := 1; ; retry++ {
+		resp, err := s3Client.HeadObject(params)
+		if needsCustomerKey(err) && key != nil && params.SSECustomerKey == nil {
+			log.Debug("[%d] Describe version %s of key '%s' with customer key.", wid, version.VersionId, version.Key)
+			params.SSECustomerAlgorithm, params.SSECustomerKey, params.SSECustomerKeyMD5 = key.Algorithm, key.Key, key.KeyMD5
+			resp, err = s3Client.HeadObject(params)
+		}
+		if err != nil {
+			if retry == common.MaxRetries {
+				log.Fatal("[%d] Error describing version %s of key '%s', retry %d: %s", wid, version.VersionId, version.Key, retry, err)
+			}
+			log.Error("[%d] Error describing version %s of key '%s', retry %d: %s", wid, version.VersionId, version.Key, retry, err)
+			continue
+		}
+		if resp.SSECustomerAlgorithm != nil {
+			version.Encryption = common.EncryptionSSEC
+		} else {
+			version.Encryption = aws.StringValue(resp.ServerSideEncryption)
+		}
+		version.KMSKeyId = aws.StringValue(resp.SSEKMSKeyID)
+		if !metadata {
+			return
+		}
+		version.ContentType = aws.StringValue(resp.ContentType)
+		version.CacheControl = aws.StringValue(resp.CacheControl)
+		version.ContentDisposition = aws.StringValue(resp.ContentDisposition)
+		version.ContentEncoding = aws.StringValue(resp.ContentEncoding)
+		version.ContentLanguage = aws.StringValue(resp.ContentLanguage)
+		if len(resp.Metadata) > 0 {
+			version.Metadata = make(map[string]string)
+			for name, value := range resp.Metadata {
+				version.Metadata[name] = aws.StringValue(value)
+			}
+		}
+		return
+	}
+}
+
+// Whether request failed for lack of a customer key. S3 answers requests
+// for SSE-C objects without their key with status 400, or 403 on HEAD.
+func needsCustomerKey(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && (reqErr.StatusCode() == 400 || reqErr.StatusCode() == 403)
+}
+
+func tagVersion(wid int, s3Client *s3.S3, version *common.Version) {
+	params := &s3.GetObjectTaggingInput{
+		Bucket:          aws.String(common.Cfg.BackupSet.SlaveBucket),
+		Key:             aws.String(version.Key),
+		VersionId:       aws.String(version.VersionId),
+	}
+	for retry := 1; ; retry++ {
+		resp, err := s3Client.GetObjectTagging(params)
+		if err != nil {
+			if retry == common.MaxRetries {
+				log.Fatal("[%d] Error fetching tags of version %s of key '%s', retry %d: %s", wid, version.VersionId, version.Key, retry, err)
+			}
+			log.Error("[%d] Error fetching tags of version %s of key '%s', retry %d: %s", wid, version.VersionId, version.Key, retry, err)
+			continue
+		}
+		if len(resp.TagSet) > 0 {
+			version.Tags = make(map[string]string)
+			for _, tag := range resp.TagSet {
+				version.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+		}
+		return
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package tag
+
+import (
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"strings"
+)
+
+// Add labels to snapshot given by selector, or remove them from it, and
+// replace its note when setNote is given. The header of the snapshot file
+// is rewritten and the snapshot stored in catalog again.
+func Tag(selector string, labels []string, remove bool, note string, setNote bool) {
+	for _, label := range labels {
+		if err := common.CheckLabel(label); err != nil {
+			log.Fatal("%s", err)
+		}
+	}
+	name := common.ResolveSnapshot(selector)
+	header := common.UpdateSnapshotHeader(name, func(header *common.SnapshotHeader) {
+		for _, label := range labels {
+			if remove {
+				header.Labels = without(header.Labels, label)
+			} else if !header.HasLabel(label) {
+				header.Labels = append(header.Labels, label)
+			}
+		}
+		if setNote {
+			header.Note = note
+		}
+	})
+	fmt.Printf("%-33s%s\n", name, strings.Join(header.Labels, ","))
+}
+
+func without(labels []string, label string) (kept []string) {
+	for _, l := range labels {
+		if l != label {
+			kept = append(kept, l)
+		}
+	}
+	return
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package verify
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type checkReport struct {
+	sync.Mutex
+	Checked              int64
+	Gone                 int64
+	Failed               int64
+}
+
+// Highest request rate of CheckSnapshots, far above what S3 serves.
+const MaxRequestRate = 1000000
+
+// Check that slave still holds every version referenced by given snapshots,
+// or by every snapshot when given "all", by means of one HEAD request per
+// version. At most rate requests per second are made, no limit when rate is
+// 0. Corrupt snapshots are reported and skipped. Exit with an error when
+// any snapshot is corrupt or any version is gone.
+func CheckSnapshots(names []string, rate int) {
+	common.ConfigureAws(common.Cfg.BackupSet.SlaveRegion)
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	broken := 0
+	files := snapshotFiles(names)
+	for _, file := range files {
+		name := filepath.Base(file)
+		snapshot := common.LoadSnapshotLeniently(file)
+		if snapshot.Corruption != nil {
+			fmt.Printf("%-33sCORRUPT: %s\n", name, snapshot.Corruption)
+			broken++
+			continue
+		}
+		log.Info("Checking versions of snapshot '%s' in slave bucket %s.", file, common.Cfg.BackupSet.SlaveBucket)
+		r := checkSnapshot(snapshot, tick)
+		if r.Gone > 0 || r.Failed > 0 {
+			fmt.Printf("%-33sBROKEN: %d of %d versions gone, %d unchecked\n", name, r.Gone, r.Checked, r.Failed)
+			broken++
+		} else {
+			fmt.Printf("%-33sOK: %d versions present\n", name, r.Checked)
+		}
+	}
+	if broken > 0 {
+		log.Error("%d of %d snapshots are corrupt or reference versions gone from slave bucket %s.", broken, len(files), common.Cfg.BackupSet.SlaveBucket)
+		os.Exit(1)
+	}
+	log.Info("Every version of %d snapshots is present in slave bucket %s.", len(files), common.Cfg.BackupSet.SlaveBucket)
+}
+
+func checkSnapshot(snapshot common.Snapshot, tick <-chan time.Time) (r checkReport) {
+	name := filepath.Base(snapshot.File)
+	work := make(chan common.Version, common.VerifyWorkerCount)
+	var workers sync.WaitGroup
+	for i := 0; i < common.VerifyWorkerCount; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s3Client := s3.New(nil)
+			for version := range work {
+				if tick != nil {
+					<-tick
+				}
+				gone, err := headVersion(s3Client, version)
+				r.Lock()
+				r.Checked++
+				if err != nil {
+					r.Failed++
+					fmt.Printf("%-33sERROR %s %s: %s\n", name, version.Key, version.VersionId, err)
+				} else if gone {
+					r.Gone++
+					fmt.Printf("%-33sGONE %s %s\n", name, version.Key, version.VersionId)
+				}
+				r.Unlock()
+			}
+		}()
+	}
+
+	common.ForEachVersion(snapshot.File, func(version common.Version) {
+		if version.DeleteMarker {
+			return
+		}
+		work <- version
+	})
+	close(work)
+	workers.Wait()
+	return
+}
+
+// Tell whether version is gone from slave. Versions of unknown encryption
+// are requested again with customer key, if any, since HEAD of an SSE-C
+// object fails without it.
+func headVersion(s3Client *s3.S3, version common.Version) (gone bool, err error) {
+	params := &s3.HeadObjectInput{
+		Bucket:          aws.String(common.Cfg.BackupSet.SlaveBucket),
+		Key:             aws.String(version.Key),
+		VersionId:       aws.String(version.VersionId),
+	}
+	key := common.SlaveCustomerKey()
+	if key != nil && version.Encryption == common.EncryptionSSEC {
+		setHeadCustomerKey(params, key)
+	}
+	unknown := key != nil && version.Encryption == ""
+	for retry := 1; ; retry++ {
+		_, err = s3Client.HeadObject(params)
+		if err != nil && !isNotFound(err) && unknown {
+			if params.SSECustomerKey == nil {
+				setHeadCustomerKey(params, key)
+			} else {
+				setHeadCustomerKey(params, nil)
+			}
+			_, err = s3Client.HeadObject(params)
+		}
+		if err == nil {
+			return false, nil
+		}
+		if isNotFound(err) {
+			return true, nil
+		}
+		if retry == common.MaxRetries {
+			return false, err
+		}
+		log.Error("Error checking version %s of key '%s', retry %d: %s", version.VersionId, version.Key, retry, err)
+	}
+}
+
+func isNotFound(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() == 404
+}
+
+func setHeadCustomerKey(params *s3.HeadObjectInput, key *common.CustomerKey) {
+	if key == nil {
+		params.SSECustomerAlgorithm, params.SSECustomerKey, params.SSECustomerKeyMD5 = nil, nil, nil
+	} else {
+		params.SSECustomerAlgorithm, params.SSECustomerKey, params.SSECustomerKeyMD5 = key.Algorithm, key.Key, key.KeyMD5
+	}
+}
@@ -0,0 +1,404 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package verify
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	Master               = "master"
+	Slave                = "slave"
+)
+
+// A key as listed in target bucket. Master has one object per key, slave
+// has every version of the key.
+type listedKey struct {
+	Key                  string
+	Objects              []listedObject
+	Deleted              bool
+}
+
+type listedObject struct {
+	VersionId            string
+	Size                 int64
+	ETag                 string
+}
+
+type lister interface {
+	next() (listedKey, bool)
+}
+
+type masterLister struct {
+	client               *s3.S3
+	params               *s3.ListObjectsInput
+	keys                 []listedKey
+	done                 bool
+}
+
+type slaveLister struct {
+	client               *s3.S3
+	params               *s3.ListObjectVersionsInput
+	keys                 []listedKey
+	done                 bool
+}
+
+type report struct {
+	sync.Mutex
+	Checked              int64
+	Missing              int64
+	Extra                int64
+	Mismatched           int64
+}
+
+// Check that target bucket, master or slave, holds every key of snapshot
+// file with the expected version, size and ETag. In deep mode, also
+// download every object and compare content hashes. Print missing, extra
+// and mismatched keys, and return false when any key is missing or
+// mismatched. Extra keys do not fail verification, since restore does not
+// remove keys from master.
+func VerifyBucket(file string, target string, deep bool) bool {
+	var bucket, region string
+	switch target {
+	case Master:
+		bucket, region = common.Cfg.BackupSet.MasterBucket, common.Cfg.BackupSet.MasterRegion
+	case Slave:
+		bucket, region = common.Cfg.BackupSet.SlaveBucket, common.Cfg.BackupSet.SlaveRegion
+	default:
+		log.Fatal("Unknown verification target '%s', expected %s or %s.", target, Master, Slave)
+	}
+	log.Info("Verifying bucket %s against snapshot '%s'.", bucket, file)
+	common.ConfigureAws(region)
+	client := s3.New(nil)
+
+	var targetKeys lister
+	if target == Master {
+		targetKeys = &masterLister{client: client, params: &s3.ListObjectsInput{Bucket: aws.String(bucket)}}
+	} else {
+		targetKeys = &slaveLister{client: client, params: &s3.ListObjectVersionsInput{Bucket: aws.String(bucket)}}
+	}
+
+	var r report
+	compareKeys(file, target, targetKeys, deep, &r)
+
+	fmt.Printf("Checked %d keys of bucket %s: %d missing, %d extra, %d mismatched.\n", r.Checked, bucket, r.Missing, r.Extra, r.Mismatched)
+	log.Info("Checked %d keys of bucket %s: %d missing, %d extra, %d mismatched.", r.Checked, bucket, r.Missing, r.Extra, r.Mismatched)
+	return r.Missing == 0 && r.Mismatched == 0
+}
+
+// Merge versions of snapshot file, sorted by key, with keys of target
+// bucket, listed in the same order, and report differences.
+func compareKeys(file string, target string, targetKeys lister, deep bool, r *report) {
+	var deepWorkQueue chan common.Version
+	var deepWorkers sync.WaitGroup
+	if deep {
+		deepWorkQueue = make(chan common.Version, common.VerifyWorkerCount)
+		for i := 0; i < common.VerifyWorkerCount; i++ {
+			deepWorkers.Add(1)
+			go func() {
+				defer deepWorkers.Done()
+				deepWorker(target, deepWorkQueue, r)
+			}()
+		}
+	}
+
+	versions := common.SortVersions(file, common.ByKey)
+	defer versions.Close()
+	nextVersion := func() (common.Version, bool) {
+		for {
+			version, ok := versions.Next()
+			if !ok || !version.DeleteMarker {
+				return version, ok
+			}
+		}
+	}
+
+	version, okV := nextVersion()
+	listed, okL := targetKeys.next()
+	for okV || okL {
+		switch {
+		case okL && listed.Deleted && len(listed.Objects) == 0:
+			listed, okL = targetKeys.next()
+		case !okL || okV && version.Key < listed.Key:
+			r.missing(version, "")
+			version, okV = nextVersion()
+		case !okV || listed.Key < version.Key:
+			if !listed.Deleted {
+				r.extra(listed.Key)
+			}
+			listed, okL = targetKeys.next()
+		default:
+			object, found := findObject(target, version, listed)
+			if !found {
+				r.missing(version, " version " + version.VersionId)
+			} else if problem := compare(target, version, object); problem != "" {
+				r.mismatch(version.Key, problem)
+			} else if deep {
+				deepWorkQueue <- version
+			} else {
+				r.ok()
+			}
+			version, okV = nextVersion()
+			listed, okL = targetKeys.next()
+		}
+	}
+	if deep {
+		close(deepWorkQueue)
+		deepWorkers.Wait()
+	}
+}
+
+// Object of listed key that should hold the version of snapshot. In slave,
+// it is the object of the very version. In master, it is the current object.
+func findObject(target string, version common.Version, listed listedKey) (listedObject, bool) {
+	if target == Master {
+		return listed.Objects[0], true
+	}
+	for _, object := range listed.Objects {
+		if object.VersionId == version.VersionId {
+			return object, true
+		}
+	}
+	return listedObject{}, false
+}
+
+// Tell how object differs from version, if it does. ETags are compared only
+// when they are comparable: in slave they are the ETags of the very same
+// version, in master they are comparable when both are MD5 digests of the
+// contents, i.e. the object was not uploaded in parts and is not encrypted
+// with KMS or customer keys.
+func compare(target string, version common.Version, object listedObject) string {
+	if object.Size != version.Size {
+		return fmt.Sprintf("size %d, expected %d", object.Size, version.Size)
+	}
+	if version.ETag == "" || object.ETag == version.ETag {
+		return ""
+	}
+	if target == Master && !(isDigest(version) && isDigestInMaster()) {
+		return ""
+	}
+	return fmt.Sprintf("ETag %s, expected %s", object.ETag, version.ETag)
+}
+
+// Tell whether ETag of version is the MD5 digest of its contents.
+func isDigest(version common.Version) bool {
+	return version.ETag != "" && !strings.Contains(version.ETag, "-") && version.Encryption != common.EncryptionKMS && version.Encryption != common.EncryptionSSEC
+}
+
+func isDigestInMaster() bool {
+	sse := common.Cfg.BackupSet.Encryption.MasterServerSideEncryption
+	return sse != common.EncryptionKMS && sse != common.EncryptionSSEC
+}
+
+// Download objects and compare their MD5 digests. An object of master is
+// compared to its version in slave. A version of slave is compared to its
+// ETag, when the ETag is a digest.
+func deepWorker(target string, queue chan common.Version, r *report) {
+	client := s3.New(nil)
+	masterKey := common.MasterCustomerKey()
+	for version := range queue {
+		var expected, actual string
+		slaveParams, alternateKey := slaveObject(version)
+		if target == Master {
+			expected = digest(client, slaveParams, alternateKey)
+			params := &s3.GetObjectInput{
+				Bucket:          aws.String(common.Cfg.BackupSet.MasterBucket),
+				Key:             aws.String(version.Key),
+			}
+			setCustomerKey(params, masterKey)
+			actual = digest(client, params, nil)
+		} else {
+			if isDigest(version) {
+				expected = version.ETag
+			}
+			actual = digest(client, slaveParams, alternateKey)
+		}
+		if expected != "" && actual != expected {
+			r.mismatch(version.Key, fmt.Sprintf("content MD5 %s, expected %s", actual, expected))
+		} else {
+			r.ok()
+		}
+	}
+}
+
+// Parameters for reading version from slave, and customer key to try when
+// reading fails because encryption of version is unknown.
+func slaveObject(version common.Version) (params *s3.GetObjectInput, alternateKey *common.CustomerKey) {
+	params = &s3.GetObjectInput{
+		Bucket:          aws.String(common.Cfg.BackupSet.SlaveBucket),
+		Key:             aws.String(version.Key),
+		VersionId:       aws.String(version.VersionId),
+	}
+	slaveKey := common.SlaveCustomerKey()
+	if version.Encryption == common.EncryptionSSEC {
+		setCustomerKey(params, slaveKey)
+	} else if version.Encryption == "" {
+		alternateKey = slaveKey
+	}
+	return
+}
+
+func setCustomerKey(params *s3.GetObjectInput, key *common.CustomerKey) {
+	if key == nil {
+		params.SSECustomerAlgorithm, params.SSECustomerKey, params.SSECustomerKeyMD5 = nil, nil, nil
+	} else {
+		params.SSECustomerAlgorithm, params.SSECustomerKey, params.SSECustomerKeyMD5 = key.Algorithm, key.Key, key.KeyMD5
+	}
+}
+
+// MD5 digest of object contents in hex. Failed reads are retried with and
+// without alternate customer key in turn.
+func digest(client *s3.S3, params *s3.GetObjectInput, alternateKey *common.CustomerKey) string {
+	for retry := 1; ; retry++ {
+		resp, err := client.GetObject(params)
+		if err == nil {
+			hash := md5.New()
+			_, err = io.Copy(hash, resp.Body)
+			resp.Body.Close()
+			if err == nil {
+				return hex.EncodeToString(hash.Sum(nil))
+			}
+		}
+		if retry == common.MaxRetries {
+			log.Fatal("Error downloading key '%s' of bucket %s, retry %d: %s", *params.Key, *params.Bucket, retry, err)
+		}
+		log.Error("Error downloading key '%s' of bucket %s, retry %d: %s", *params.Key, *params.Bucket, retry, err)
+		if alternateKey != nil {
+			if params.SSECustomerKey == nil {
+				setCustomerKey(params, alternateKey)
+			} else {
+				setCustomerKey(params, nil)
+			}
+		}
+	}
+}
+
+func (r *report) ok() {
+	r.Lock()
+	defer r.Unlock()
+	r.Checked++
+}
+
+func (r *report) missing(version common.Version, what string) {
+	r.Lock()
+	defer r.Unlock()
+	r.Checked++
+	r.Missing++
+	fmt.Printf("MISSING    %s%s\n", version.Key, what)
+}
+
+func (r *report) extra(key string) {
+	r.Lock()
+	defer r.Unlock()
+	r.Extra++
+	fmt.Printf("EXTRA      %s\n", key)
+}
+
+func (r *report) mismatch(key string, problem string) {
+	r.Lock()
+	defer r.Unlock()
+	r.Checked++
+	r.Mismatched++
+	fmt.Printf("MISMATCH   %s: %s\n", key, problem)
+}
+
+func (l *masterLister) next() (k listedKey, ok bool) {
+	for len(l.keys) == 0 && !l.done {
+		resp, err := l.client.ListObjects(l.params)
+		if err != nil {
+			log.Fatal("Could not list bucket %s: %s", aws.StringValue(l.params.Bucket), err)
+		}
+		for _, object := range resp.Contents {
+			l.keys = append(l.keys, listedKey{
+				Key: *object.Key,
+				Objects: []listedObject{{Size: aws.Int64Value(object.Size), ETag: strings.Trim(aws.StringValue(object.ETag), "\"")}},
+			})
+		}
+		l.done = !aws.BoolValue(resp.IsTruncated) || len(resp.Contents) == 0
+		if !l.done {
+			l.params.Marker = resp.Contents[len(resp.Contents) - 1].Key
+		}
+	}
+	if len(l.keys) == 0 {
+		return
+	}
+	k, l.keys = l.keys[0], l.keys[1:]
+	return k, true
+}
+
+// Keys of slave are complete only when the next key is listed, since the
+// versions of a key may continue in the next batch.
+func (l *slaveLister) next() (k listedKey, ok bool) {
+	for len(l.keys) < 2 && !l.done {
+		l.fetch()
+	}
+	if len(l.keys) == 0 {
+		return
+	}
+	k, l.keys = l.keys[0], l.keys[1:]
+	return k, true
+}
+
+func (l *slaveLister) fetch() {
+	resp, err := l.client.ListObjectVersions(l.params)
+	if err != nil {
+		log.Fatal("Could not list versions of bucket %s: %s", aws.StringValue(l.params.Bucket), err)
+	}
+	var batch []listedKey
+	for _, v := range resp.Versions {
+		batch = append(batch, listedKey{
+			Key: *v.Key,
+			Objects: []listedObject{{VersionId: aws.StringValue(v.VersionId), Size: aws.Int64Value(v.Size), ETag: strings.Trim(aws.StringValue(v.ETag), "\"")}},
+		})
+	}
+	for _, m := range resp.DeleteMarkers {
+		batch = append(batch, listedKey{Key: *m.Key, Deleted: aws.BoolValue(m.IsLatest)})
+	}
+	sort.Stable(byKey(batch))
+	for _, k := range batch {
+		if common.IsCatalogKey(k.Key) {
+			continue
+		}
+		if last := len(l.keys) - 1; last >= 0 && l.keys[last].Key == k.Key {
+			l.keys[last].Objects = append(l.keys[last].Objects, k.Objects...)
+			l.keys[last].Deleted = l.keys[last].Deleted || k.Deleted
+		} else {
+			l.keys = append(l.keys, k)
+		}
+	}
+	l.done = !aws.BoolValue(resp.IsTruncated)
+	l.params.KeyMarker = resp.NextKeyMarker
+	l.params.VersionIdMarker = resp.NextVersionIdMarker
+}
+
+type byKey []listedKey
+
+func (k byKey) Len() int           { return len(k) }
+func (k byKey) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k byKey) Less(i, j int) bool { return k[i].Key < k[j].Key }
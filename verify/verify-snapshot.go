@@ -0,0 +1,60 @@
+/*
+Copyright 2015 ASM Clasificados de Mexico, SA de CV
+
+This file is part of backup-my-bucket.
+
+backup-my-bucket is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License Version 2 as published by
+the Free Software Foundation.
+
+backup-my-bucket is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with backup-my-bucket.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package verify
+
+import (
+	"fmt"
+	"github.com/SegundamanoMX/backup-my-bucket/common"
+	"github.com/SegundamanoMX/backup-my-bucket/log"
+	"os"
+	"path/filepath"
+)
+
+// Verify integrity of given snapshots, or of every snapshot when given
+// "all". Exit with an error when any snapshot is corrupt.
+func VerifySnapshots(names []string) {
+	files := snapshotFiles(names)
+	corrupt := 0
+	for _, file := range files {
+		log.Info("Verifying snapshot file '%s'.", file)
+		if err := common.VerifySnapshot(file); err != nil {
+			log.Error("Snapshot file '%s' is CORRUPT: %s", file, err)
+			fmt.Printf("%-33sCORRUPT: %s\n", filepath.Base(file), err)
+			corrupt++
+		} else {
+			fmt.Printf("%-33sOK\n", filepath.Base(file))
+		}
+	}
+	if corrupt > 0 {
+		log.Error("%d of %d snapshots are corrupt.", corrupt, len(files))
+		os.Exit(1)
+	}
+	log.Info("All %d snapshots are sound.", len(files))
+}
+
+// Local copies of given snapshots, or of every snapshot when given "all".
+func snapshotFiles(names []string) (files []string) {
+	if len(names) == 1 && names[0] == "all" {
+		return common.SnapshotFiles()
+	}
+	for _, name := range names {
+		files = append(files, common.FetchSnapshot(name))
+	}
+	return
+}